@@ -0,0 +1,374 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultAPIKeyHeader is the request header carrying the key when apiKeys.header is not configured.
+	defaultAPIKeyHeader = "X-API-Key"
+
+	// usageParam is the reserved first path segment of the usage report.
+	usageParam = "_usage"
+
+	// apiKeyTTL is how long keys read from Firestore, or their absence, are cached.
+	apiKeyTTL = time.Minute
+
+	// maxCachedAPIKeys limits the keys, and the absences of unknown keys, cached from Firestore.
+	maxCachedAPIKeys = 10000
+)
+
+// retryAfterError is a quota error that tells the caller when to retry.
+type retryAfterError struct {
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// apiKeyContextKey is the context key of the API key of the request.
+type apiKeyContextKey struct{}
+
+// requestAPIKey returns the API key the request was made with, or nil.
+func requestAPIKey(ctx context.Context) *apiKey {
+	k, _ := ctx.Value(apiKeyContextKey{}).(*apiKey)
+	return k
+}
+
+// usageKey identifies the key in the usage store. Names need not be unique across the configuration file and
+// Firestore, so the usage is counted by hash.
+func (k *apiKey) usageKey() string {
+	return strings.ToLower(k.Hash)
+}
+
+// hashAPIKey returns the hex encoded SHA-256 hash that keys are stored as.
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// authenticateKey looks up the API key of the request and returns the request with the key in its context.
+// Unknown keys are rejected with 401 Unauthorized, as are requests without a key or a verified identity when keys
+// are required.
+func authenticateKey(r *http.Request, cfg *apiKeysConfig) (*http.Request, error) {
+	header := cfg.Header
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+	presented := r.Header.Get(header)
+	if presented == "" {
+		if cfg.Required && requestIdentity(r.Context()) == nil {
+			return nil, &statusError{http.StatusUnauthorized, fmt.Errorf("an API key is required in the %s header", header)}
+		}
+		return r, nil
+	}
+
+	k, err := lookupAPIKey(r.Context(), cfg, hashAPIKey(presented))
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, &statusError{http.StatusUnauthorized, errors.New("the API key is not valid")}
+	}
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, k)), nil
+}
+
+// lookupAPIKey returns the key with the hash from the configuration file or from Firestore, or nil.
+func lookupAPIKey(ctx context.Context, cfg *apiKeysConfig, hash string) (*apiKey, error) {
+	for i := range cfg.Keys {
+		k := &cfg.Keys[i]
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(k.Hash)), []byte(hash)) == 1 {
+			return k, nil
+		}
+	}
+	if cfg.Firestore == "" {
+		return nil, nil
+	}
+	return firestoreKeys.lookup(ctx, cfg.Firestore, hash)
+}
+
+// firestoreKeyCache caches the keys read from Firestore.
+type firestoreKeyCache struct {
+	mu      sync.Mutex
+	clients map[string]*firestore.Client
+	keys    map[string]cachedAPIKey
+}
+
+// cachedAPIKey is a key read from Firestore, or its absence when key is nil.
+type cachedAPIKey struct {
+	key     *apiKey
+	expires time.Time
+}
+
+// firestoreKeys is the process wide cache of the keys read from Firestore.
+var firestoreKeys = &firestoreKeyCache{clients: map[string]*firestore.Client{}, keys: map[string]cachedAPIKey{}}
+
+// lookup returns the key stored in the project/collection document named by the hash, or nil.
+func (c *firestoreKeyCache) lookup(ctx context.Context, collection, hash string) (*apiKey, error) {
+	c.mu.Lock()
+	if ck, ok := c.keys[hash]; ok && time.Now().Before(ck.expires) {
+		c.mu.Unlock()
+		return ck.key, nil
+	}
+	c.mu.Unlock()
+
+	client, col, err := c.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := client.Collection(col).Doc(hash).Get(ctx)
+	var k *apiKey
+	switch {
+	case status.Code(err) == codes.NotFound:
+	case err != nil:
+		return nil, fmt.Errorf("reading API key: %v", err)
+	default:
+		k = &apiKey{Hash: hash}
+		if err := snap.DataTo(k); err != nil {
+			return nil, fmt.Errorf("reading API key: %v", err)
+		}
+	}
+
+	now := time.Now()
+	c.put(hash, cachedAPIKey{key: k, expires: now.Add(apiKeyTTL)}, now)
+	return k, nil
+}
+
+// put caches the key, or its absence, for hash. When the cache is full the expired keys are dropped, then the key
+// that expires first, so that unknown keys can not grow the cache without bound.
+func (c *firestoreKeyCache) put(hash string, ck cachedAPIKey, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.keys[hash]; !ok && len(c.keys) >= maxCachedAPIKeys {
+		var oldest string
+		for h, v := range c.keys {
+			if !now.Before(v.expires) {
+				delete(c.keys, h)
+				continue
+			}
+			if oldest == "" || v.expires.Before(c.keys[oldest].expires) {
+				oldest = h
+			}
+		}
+		if len(c.keys) >= maxCachedAPIKeys {
+			delete(c.keys, oldest)
+		}
+	}
+	c.keys[hash] = ck
+}
+
+// collection returns the Firestore client of the project/collection path and the collection path.
+func (c *firestoreKeyCache) collection(path string) (*firestore.Client, string, error) {
+	i := strings.Index(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		return nil, "", fmt.Errorf("apiKeys.firestore %q must be in the form project/collection", path)
+	}
+	project, col := path[:i], path[i+1:]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	client, ok := c.clients[project]
+	if !ok {
+		var err error
+		if client, err = firestore.NewClient(context.Background(), project); err != nil {
+			return nil, "", err
+		}
+		clientsCreated.WithLabelValues("firestore").Inc()
+		c.clients[project] = client
+	}
+	return client, col, nil
+}
+
+// all returns the keys stored in the Firestore collection.
+func (c *firestoreKeyCache) all(ctx context.Context, collection string) ([]*apiKey, error) {
+	client, col, err := c.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*apiKey
+	it := client.Collection(col).Documents(ctx)
+	defer it.Stop()
+	for {
+		snap, err := it.Next()
+		if err == iterator.Done {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		k := &apiKey{Hash: snap.Ref.ID}
+		if err := snap.DataTo(k); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+}
+
+// admitKey checks that the key may use the path and has quota left, and counts the request. Keys over their quota
+// are rejected with 429 Too Many Requests and told when to retry. The rows and bytes of a response are only known
+// once it is read, so the request that crosses a daily quota is still served in full.
+func admitKey(ctx context.Context, k *apiKey, store usageStore, path string, now time.Time) error {
+	if len(k.Routes) > 0 {
+		allowed := false
+		for _, route := range k.Routes {
+			if routeMatches(route, path) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &statusError{http.StatusForbidden, fmt.Errorf("API key %s may not use %s", k.Name, path)}
+		}
+	}
+
+	u, err := store.usage(ctx, k.usageKey(), now)
+	if err != nil {
+		return err
+	}
+	if k.DailyRows > 0 && u.Rows >= k.DailyRows || k.DailyBytes > 0 && u.Bytes >= k.DailyBytes {
+		midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return &statusError{http.StatusTooManyRequests, &retryAfterError{midnight.Sub(now),
+			fmt.Errorf("API key %s has used its daily quota of %d rows and %d bytes", k.Name, k.DailyRows, k.DailyBytes)}}
+	}
+
+	n, err := store.hit(ctx, k.usageKey(), now)
+	if err != nil {
+		return err
+	}
+	if k.RequestsPerMinute > 0 && n > k.RequestsPerMinute {
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		return &statusError{http.StatusTooManyRequests, &retryAfterError{next.Sub(now),
+			fmt.Errorf("API key %s is limited to %d requests per minute", k.Name, k.RequestsPerMinute)}}
+	}
+	return nil
+}
+
+// writeError writes the error with its status, and the Retry-After header of quota errors.
+func writeError(w http.ResponseWriter, err error) {
+	var ra *retryAfterError
+	if errors.As(err, &ra) {
+		secs := int64((ra.retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+	http.Error(w, err.Error(), errorStatus(err))
+}
+
+// recordUsage counts the rows and bytes of the response against the API key of the request. The response is
+// already on its way so failures are only logged.
+func recordUsage(ctx context.Context, store usageStore, k *apiKey, body []byte, now time.Time) {
+	if err := store.record(ctx, k.usageKey(), responseRows(body), int64(len(body)), now); err != nil {
+		log.Printf("usage: recording %s: %v", k.Name, err)
+	}
+}
+
+// responseRows returns the number of rows in a response: the length of a JSON array, or one for any other body.
+func responseRows(body []byte) int64 {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return 0
+	}
+	if body[0] != '[' {
+		return 1
+	}
+	var rows []json.RawMessage
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return 1
+	}
+	return int64(len(rows))
+}
+
+// serveUsage handles GET /_usage. A request made with an API key reports the usage of its key, and a request from a
+// verified identity named by apiKeys.admins reports the usage of every key.
+func serveUsage(w http.ResponseWriter, r *http.Request, cfg *apiKeysConfig) {
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("method %s is not supported for this path", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var keys []*apiKey
+	switch {
+	case requestAPIKey(r.Context()) != nil:
+		keys = []*apiKey{requestAPIKey(r.Context())}
+
+	case requestIdentity(r.Context()) != nil:
+		if !requestPrincipal(r).matches(cfg.Admins) {
+			http.Error(w, "the usage of every key is only reported to apiKeys.admins", http.StatusForbidden)
+			return
+		}
+		for i := range cfg.Keys {
+			keys = append(keys, &cfg.Keys[i])
+		}
+		if cfg.Firestore != "" {
+			fk, err := firestoreKeys.all(r.Context(), cfg.Firestore)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			keys = append(keys, fk...)
+		}
+
+	default:
+		http.Error(w, "the usage report requires an API key or a verified identity", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now()
+	report := make([]keyUsage, 0, len(keys))
+	for _, k := range keys {
+		u, err := getUsageStore(cfg).usage(r.Context(), k.usageKey(), now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		u.Key = k.Name
+		u.RequestsPerMinute, u.DailyRows, u.DailyBytes = k.RequestsPerMinute, k.DailyRows, k.DailyBytes
+		report = append(report, u)
+	}
+
+	bts, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bts)
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthenticateKey(t *testing.T) {
+	cfg := &apiKeysConfig{Keys: []apiKey{{Name: "partner-a", Hash: hashAPIKey("secret-a")}}}
+
+	var tests = []struct {
+		required bool
+		key      string
+		caller   string
+		want     string
+		code     int
+	}{
+		{false, "secret-a", "", "apikey:partner-a", 0},
+		{false, "", "", "", 0},
+		{false, "wrong", "", "", http.StatusUnauthorized},
+		{true, "", "", "", http.StatusUnauthorized},
+		{true, "", "user@example.com", "user@example.com", 0},
+	}
+
+	for _, item := range tests {
+		cfg.Required = item.required
+		req := httptest.NewRequest("GET", "/bq/p/d/v", nil)
+		if item.key != "" {
+			req.Header.Set("X-API-Key", item.key)
+		}
+		if item.caller != "" {
+			req = req.WithContext(withIdentity(req.Context(), &identity{Email: item.caller}))
+		}
+		req, err := authenticateKey(req, cfg)
+		if item.code != 0 {
+			if errorStatus(err) != item.code {
+				t.Errorf("authenticateKey(%q, required %v) error = %v Want: status %d", item.key, item.required, err, item.code)
+			}
+			continue
+		}
+		if err != nil || requestCaller(req) != item.want {
+			t.Errorf("authenticateKey(%q, required %v) caller = %q, %v Want: %q", item.key, item.required, requestCaller(req), err, item.want)
+		}
+	}
+
+	// The unsigned header of Identity-Aware Proxy is not a verified identity.
+	req := httptest.NewRequest("GET", "/bq/p/d/v", nil)
+	req.Header.Set("X-Goog-Authenticated-User-Email", "accounts.google.com:user@example.com")
+	if _, err := authenticateKey(req, cfg); errorStatus(err) != http.StatusUnauthorized {
+		t.Errorf("authenticateKey(unsigned IAP header, required) error = %v Want: 401 Unauthorized", err)
+	}
+}
+
+func TestFirestoreKeyCachePut(t *testing.T) {
+	c := &firestoreKeyCache{keys: map[string]cachedAPIKey{}}
+	now := time.Now()
+
+	// Unknown keys fill the cache, one of them already expired.
+	c.put("expired", cachedAPIKey{expires: now.Add(-time.Second)}, now)
+	for i := 1; i < maxCachedAPIKeys; i++ {
+		c.put(strconv.Itoa(i), cachedAPIKey{expires: now.Add(time.Duration(i) * time.Millisecond)}, now)
+	}
+
+	// A full cache drops the expired keys first.
+	c.put("a", cachedAPIKey{key: &apiKey{Name: "a"}, expires: now.Add(apiKeyTTL)}, now)
+	if _, ok := c.keys["expired"]; ok || len(c.keys) != maxCachedAPIKeys {
+		t.Errorf("put(a) kept %d keys, expired %v Want: %d without the expired key", len(c.keys), ok, maxCachedAPIKeys)
+	}
+
+	// Then the key that expires first.
+	c.put("b", cachedAPIKey{key: &apiKey{Name: "b"}, expires: now.Add(apiKeyTTL)}, now)
+	if _, ok := c.keys["1"]; ok || len(c.keys) != maxCachedAPIKeys {
+		t.Errorf("put(b) kept %d keys, first to expire %v Want: %d without the first to expire", len(c.keys), ok, maxCachedAPIKeys)
+	}
+}
+
+func TestAdmitKey(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 6, 1, 23, 59, 30, 0, time.UTC)
+	k := &apiKey{Name: "partner-a", Routes: []string{"bq/p/shared/*"}, RequestsPerMinute: 2, DailyRows: 10}
+	store := newMemoryUsage()
+
+	if err := admitKey(ctx, k, store, "/bq/p/private/v", now); errorStatus(err) != http.StatusForbidden {
+		t.Errorf("admitKey(private) error = %v Want: status %d", err, http.StatusForbidden)
+	}
+	for i := 0; i < 2; i++ {
+		if err := admitKey(ctx, k, store, "/bq/p/shared/v", now); err != nil {
+			t.Fatalf("admitKey(request %d) error: %v", i+1, err)
+		}
+	}
+
+	var tests = []struct {
+		name string
+		now  time.Time
+		want string
+	}{
+		{"per minute", now, "30"},
+		{"next minute", now.Add(time.Minute), ""},
+	}
+	for _, item := range tests {
+		w := httptest.NewRecorder()
+		err := admitKey(ctx, k, store, "/bq/p/shared/v", item.now)
+		if item.want == "" {
+			if err != nil {
+				t.Errorf("admitKey(%s) error: %v", item.name, err)
+			}
+			continue
+		}
+		writeError(w, err)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != item.want {
+			t.Errorf("admitKey(%s) = %d, Retry-After %q Want: %d, %q", item.name, w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests, item.want)
+		}
+	}
+
+	// The daily quota lasts until midnight UTC.
+	later := now.Add(-time.Hour)
+	recordUsage(ctx, store, k, []byte(`[1,2,3,4,5,6,7,8,9,10]`), later)
+	w := httptest.NewRecorder()
+	writeError(w, admitKey(ctx, k, store, "/bq/p/shared/v", later))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3630" {
+		t.Errorf("admitKey(daily rows) = %d, Retry-After %q Want: %d, %q", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests, "3630")
+	}
+
+	// Keys sharing a name, such as unnamed Firestore keys, have quotas of their own.
+	a := &apiKey{Hash: hashAPIKey("secret-a"), DailyRows: 1}
+	b := &apiKey{Hash: hashAPIKey("secret-b"), DailyRows: 1}
+	recordUsage(ctx, store, a, []byte(`[1]`), later)
+	if err := admitKey(ctx, b, store, "/bq/p/shared/v", later); err != nil {
+		t.Errorf("admitKey(same name) error = %v Want: the quota of its own key", err)
+	}
+}
+
+func TestResponseRows(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want int64
+	}{
+		{`[{"a":1},{"a":2}]`, 2},
+		{` [] `, 0},
+		{`{"a":1}`, 1},
+		{``, 0},
+		{`[1,`, 1},
+	}
+
+	for _, item := range tests {
+		if have := responseRows([]byte(item.in)); have != item.want {
+			t.Errorf("responseRows(%q) = %d Want: %d", item.in, have, item.want)
+		}
+	}
+}
+
+func TestServeUsage(t *testing.T) {
+	cfg := &apiKeysConfig{Keys: []apiKey{
+		{Name: "usage-a", Hash: hashAPIKey("secret-a"), DailyRows: 100},
+		{Name: "usage-b", Hash: hashAPIKey("secret-b")},
+	}, Admins: []string{"admin@example.com"}}
+	recordUsage(context.Background(), getUsageStore(cfg), &cfg.Keys[0], []byte(`[1,2,3]`), time.Now())
+
+	var tests = []struct {
+		header string
+		value  string
+		caller string
+		code   int
+		keys   []string
+	}{
+		{"X-API-Key", "secret-a", "", http.StatusOK, []string{"usage-a"}},
+		{"", "", "admin@example.com", http.StatusOK, []string{"usage-a", "usage-b"}},
+		{"", "", "user@example.com", http.StatusForbidden, nil},
+		{"X-Goog-Authenticated-User-Email", "accounts.google.com:admin@example.com", "", http.StatusUnauthorized, nil},
+		{"", "", "", http.StatusUnauthorized, nil},
+	}
+
+	for _, item := range tests {
+		req := httptest.NewRequest("GET", "/_usage", nil)
+		if item.header != "" {
+			req.Header.Set(item.header, item.value)
+		}
+		if item.caller != "" {
+			req = req.WithContext(withIdentity(req.Context(), &identity{Email: item.caller}))
+		}
+		req, err := authenticateKey(req, cfg)
+		if err != nil {
+			t.Fatalf("authenticateKey(%s) error: %v", item.header, err)
+		}
+		w := httptest.NewRecorder()
+		serveUsage(w, req, cfg)
+		if w.Code != item.code {
+			t.Errorf("serveUsage(%s) = %d Want: %d", item.header, w.Code, item.code)
+			continue
+		}
+		if item.code != http.StatusOK {
+			continue
+		}
+
+		var report []keyUsage
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("serveUsage(%s) body %q: %v", item.header, w.Body.String(), err)
+		}
+		var keys []string
+		for _, u := range report {
+			keys = append(keys, u.Key)
+		}
+		if len(keys) != len(item.keys) || keys[0] != item.keys[0] || report[0].Rows != 3 || report[0].DailyRows != 100 {
+			t.Errorf("serveUsage(%s) = %+v Want: keys %v", item.header, report, item.keys)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// googleIssuer is the issuer of Google-signed ID tokens. Google also issues tokens with the issuer
+	// accounts.google.com.
+	googleIssuer = "https://accounts.google.com"
+
+	// googleJWKSURL serves the keys that sign Google ID tokens.
+	googleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+	// iapIssuer is the issuer of the signed headers of Identity-Aware Proxy.
+	iapIssuer = "https://cloud.google.com/iap"
+
+	// iapAssertionHeader carries the signed header of Identity-Aware Proxy.
+	iapAssertionHeader = "X-Goog-IAP-JWT-Assertion"
+
+	// clockSkew is the leeway given to the time claims of a token.
+	clockSkew = time.Minute
+
+	// defaultJWKSTTL is how long keys are cached when the JWKS response has no max-age.
+	defaultJWKSTTL = time.Hour
+
+	// minJWKSRefresh limits how often an unknown key id refreshes the keys of an issuer.
+	minJWKSRefresh = time.Minute
+)
+
+// iapJWKSURL serves the keys that sign the headers of Identity-Aware Proxy. It is a variable so tests can serve
+// their own keys.
+var iapJWKSURL = "https://www.gstatic.com/iap/verify/public_key-jwk"
+
+// identity is the caller verified from a bearer token.
+type identity struct {
+	Issuer  string
+	Subject string
+	Email   string
+
+	// Claims holds every claim of the token for authorization decisions.
+	Claims map[string]interface{}
+}
+
+// name returns the email of the caller. When the token has no verified email the caller is named sub:{issuer}/{subject},
+// as a subject is only unique within its issuer and may look like an email.
+func (id *identity) name() string {
+	if id.Email != "" {
+		return id.Email
+	}
+	return subjectPrefix + id.Issuer + "/" + id.Subject
+}
+
+// verifiedEmail reports whether the issuer verified the email claim of the token. Some issuers send the
+// email_verified claim as a string.
+func verifiedEmail(claims map[string]interface{}) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// identityKey is the context key of the verified identity.
+type identityKey struct{}
+
+// withIdentity returns a copy of ctx carrying the verified identity.
+func withIdentity(ctx context.Context, id *identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// requestIdentity returns the identity verified for the request, or nil for anonymous requests.
+func requestIdentity(ctx context.Context) *identity {
+	id, _ := ctx.Value(identityKey{}).(*identity)
+	return id
+}
+
+// authenticate verifies the signed header of Identity-Aware Proxy when auth.iap is configured, or else the bearer
+// token of the request when auth.issuers is configured, and returns the request with the verified identity in its
+// context. Requests without a valid token are rejected with 401 Unauthorized unless anonymous requests are allowed.
+// Identity-Aware Proxy signs every request it lets through, so its header is always required.
+func authenticate(r *http.Request, cfg *authConfig) (*http.Request, error) {
+	if cfg.IAP != nil {
+		id, err := verifyIAPAssertion(r.Context(), r.Header.Get(iapAssertionHeader), cfg.IAP, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return r.WithContext(withIdentity(r.Context(), id)), nil
+	}
+	if len(cfg.Issuers) == 0 {
+		return r, nil
+	}
+
+	h := r.Header.Get("Authorization")
+	if h == "" && cfg.AllowAnonymous {
+		return r, nil
+	}
+	if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+		return nil, &statusError{http.StatusUnauthorized, errors.New("a bearer token is required")}
+	}
+
+	id, err := verifyToken(r.Context(), strings.TrimSpace(h[7:]), cfg.Issuers, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return r.WithContext(withIdentity(r.Context(), id)), nil
+}
+
+// verifyIAPAssertion verifies the signed header Identity-Aware Proxy adds to the requests it lets through and
+// returns the identity of the caller. IAP only signs emails it has verified.
+func verifyIAPAssertion(ctx context.Context, assertion string, cfg *iapConfig, now time.Time) (*identity, error) {
+	if assertion == "" {
+		return nil, &statusError{http.StatusUnauthorized, fmt.Errorf("the %s header is required", iapAssertionHeader)}
+	}
+	if cfg.Audience == "" {
+		return nil, &statusError{http.StatusInternalServerError, errors.New("auth.iap.audience is not configured")}
+	}
+	issuers := []issuerConfig{{Issuer: iapIssuer, JWKSURL: iapJWKSURL, Audiences: []string{cfg.Audience}}}
+	id, err := verifyToken(ctx, assertion, issuers, now)
+	if err != nil {
+		return nil, err
+	}
+	id.Email, _ = id.Claims["email"].(string)
+	return id, nil
+}
+
+// jwtHeader is the JOSE header of a token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifyToken checks the signature, issuer, audience and validity period of the token and returns its identity.
+// Verification failures are 401 Unauthorized errors.
+func verifyToken(ctx context.Context, token string, issuers []issuerConfig, now time.Time) (*identity, error) {
+	unauthorized := func(format string, a ...interface{}) error {
+		return &statusError{http.StatusUnauthorized, fmt.Errorf("invalid token: "+format, a...)}
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, unauthorized("not a JWT")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, unauthorized("header: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, unauthorized("claims: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, unauthorized("signature: %v", err)
+	}
+
+	// Select the trusted issuer before fetching any key.
+	iss, _ := claims["iss"].(string)
+	ic := findIssuer(issuers, iss)
+	if ic == nil {
+		return nil, unauthorized("untrusted issuer %q", iss)
+	}
+	if len(ic.Audiences) == 0 {
+		return nil, fmt.Errorf("auth issuer %s has no audiences", ic.Issuer)
+	}
+	if !audienceMatches(claims["aud"], ic.Audiences) {
+		return nil, unauthorized("unexpected audience %v", claims["aud"])
+	}
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, unauthorized("no expiry")
+	}
+	if now.After(time.Unix(exp, 0).Add(clockSkew)) {
+		return nil, unauthorized("expired")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(clockSkew).Before(time.Unix(nbf, 0)) {
+		return nil, unauthorized("not valid yet")
+	}
+
+	// Verify the signature with the key of the issuer named by the token.
+	key, err := jwksFor(ic).key(ctx, header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, unauthorized("%v", err)
+	}
+
+	id := &identity{Issuer: iss, Claims: claims}
+	id.Subject, _ = claims["sub"].(string)
+	if verifiedEmail(claims) {
+		id.Email, _ = claims["email"].(string)
+	}
+	return id, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(s string, v interface{}) error {
+	bts, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bts, v)
+}
+
+// findIssuer returns the trusted issuer of the token, or nil.
+func findIssuer(issuers []issuerConfig, iss string) *issuerConfig {
+	for i := range issuers {
+		ic := &issuers[i]
+		if ic.Issuer == iss || ic.Issuer == googleIssuer && iss == strings.TrimPrefix(googleIssuer, "https://") {
+			return ic
+		}
+	}
+	return nil
+}
+
+// audienceMatches reports whether the aud claim, a string or an array of strings, names one of the audiences.
+func audienceMatches(aud interface{}, audiences []string) bool {
+	var auds []string
+	switch t := aud.(type) {
+	case string:
+		auds = []string{t}
+	case []interface{}:
+		for _, a := range t {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	for _, a := range auds {
+		for _, want := range audiences {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// numericClaim returns the NumericDate claim in seconds.
+func numericClaim(claims map[string]interface{}, name string) (int64, bool) {
+	f, ok := claims[name].(float64)
+	return int64(f), ok
+}
+
+// verifySignature checks the RS256 or ES256 signature of the signed input.
+func verifySignature(alg string, key crypto.PublicKey, input string, sig []byte) error {
+	digest := sha256.Sum256([]byte(input))
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("the key does not match the RS256 algorithm")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return errors.New("the key or signature does not match the ES256 algorithm")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// jwks caches the signing keys of an issuer.
+type jwks struct {
+	issuer string
+
+	// url is the JWKS endpoint. When empty it is discovered from the OpenID configuration of the issuer.
+	url string
+
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	expires time.Time
+	fetched time.Time
+}
+
+var (
+	// jwksMu guards jwksSets, the process wide key caches keyed by issuer and JWKS URL.
+	jwksMu   sync.Mutex
+	jwksSets = map[string]*jwks{}
+)
+
+// jwksFor returns the key cache of the issuer.
+func jwksFor(ic *issuerConfig) *jwks {
+	u := ic.JWKSURL
+	if u == "" && ic.Issuer == googleIssuer {
+		u = googleJWKSURL
+	}
+
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+	k := ic.Issuer + " " + u
+	s, ok := jwksSets[k]
+	if !ok {
+		s = &jwks{issuer: ic.Issuer, url: u, client: &http.Client{Timeout: 10 * time.Second}}
+		jwksSets[k] = s
+	}
+	return s
+}
+
+// key returns the key with the key id. The keys are fetched again once they expire, or when the key id is unknown
+// and the keys were not fetched within the last minute.
+func (s *jwks) key(ctx context.Context, kid string, now time.Time) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[kid]
+	if ok && now.Before(s.expires) {
+		return k, nil
+	}
+	if ok || now.Sub(s.fetched) >= minJWKSRefresh {
+		if err := s.refresh(ctx, now); err != nil {
+			return nil, fmt.Errorf("fetching the keys of %s: %v", s.issuer, err)
+		}
+		k, ok = s.keys[kid]
+	}
+	if !ok {
+		return nil, &statusError{http.StatusUnauthorized, fmt.Errorf("invalid token: unknown key id %q", kid)}
+	}
+	return k, nil
+}
+
+// jwkSet is the JSON Web Key Set document.
+type jwkSet struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+// refresh fetches the keys. The caller holds s.mu.
+func (s *jwks) refresh(ctx context.Context, now time.Time) error {
+	s.fetched = now
+	if s.url == "" {
+		var oc struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if _, err := s.getJSON(ctx, strings.TrimSuffix(s.issuer, "/")+"/.well-known/openid-configuration", &oc); err != nil {
+			return err
+		}
+		if oc.JWKSURI == "" {
+			return errors.New("the OpenID configuration has no jwks_uri")
+		}
+		s.url = oc.JWKSURI
+	}
+
+	var set jwkSet
+	ttl, err := s.getJSON(ctx, s.url, &set)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+		case "EC":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if k.Crv != "P-256" || err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	s.keys = keys
+	s.expires = now.Add(ttl)
+	return nil
+}
+
+// getJSON decodes the JSON document at u and returns how long it may be cached.
+func (s *jwks) getJSON(ctx context.Context, u string, v interface{}) (time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return 0, err
+	}
+	return maxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+// maxAge returns the max-age of a Cache-Control header, or defaultJWKSTTL.
+func maxAge(cc string) time.Duration {
+	for _, d := range strings.Split(cc, ",") {
+		d = strings.TrimSpace(d)
+		if strings.HasPrefix(d, "max-age=") {
+			if n, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil && n > 0 {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+	return defaultJWKSTTL
+}
@@ -0,0 +1,329 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIssuer is a local OpenID Connect issuer that serves its JWKS and signs tokens.
+type testIssuer struct {
+	*httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	fetches int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey() error: %v", err)
+	}
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error: %v", err)
+	}
+	ti := &testIssuer{rsaKey: rk, ecKey: ek}
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": ti.URL, "jwks_uri": ti.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ti.fetches, 1)
+		w.Header().Set("Cache-Control", "public, max-age=600")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rk.N.Bytes()), "e": b64(big.NewInt(int64(rk.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ek.X.Bytes()), "y": b64(ek.Y.Bytes())},
+		}})
+	})
+	ti.Server = httptest.NewServer(mux)
+	return ti
+}
+
+// sign returns a token with the claims signed by the key of kid.
+func (ti *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		bts, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(bts)
+	}
+	input := enc(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, ti.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, ti.ecKey, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	if err != nil {
+		t.Fatalf("signing the token: %v", err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyToken(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+
+	now := time.Now()
+	issuers := []issuerConfig{{Issuer: ti.URL, Audiences: []string{"data-drive"}}}
+	claims := func(mod func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":            ti.URL,
+			"aud":            "data-drive",
+			"sub":            "1234",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"exp":            now.Add(time.Hour).Unix(),
+		}
+		if mod != nil {
+			mod(c)
+		}
+		return c
+	}
+
+	var tests = []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"rs256", ti.sign(t, "RS256", "rsa1", claims(nil)), 0},
+		{"es256", ti.sign(t, "ES256", "ec1", claims(nil)), 0},
+		{"audience list", ti.sign(t, "RS256", "rsa1", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", "data-drive"} })), 0},
+		{"expired", ti.sign(t, "RS256", "rsa1", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() })), http.StatusUnauthorized},
+		{"not yet valid", ti.sign(t, "RS256", "rsa1", claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })), http.StatusUnauthorized},
+		{"audience", ti.sign(t, "RS256", "rsa1", claims(func(c map[string]interface{}) { c["aud"] = "other" })), http.StatusUnauthorized},
+		{"issuer", ti.sign(t, "RS256", "rsa1", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })), http.StatusUnauthorized},
+		{"key id", ti.sign(t, "RS256", "rsa2", claims(nil)), http.StatusUnauthorized},
+		{"algorithm", ti.sign(t, "RS256", "ec1", claims(nil)), http.StatusUnauthorized},
+		{"tampered", ti.sign(t, "RS256", "rsa1", claims(nil)) + "A", http.StatusUnauthorized},
+		{"malformed", "not-a-token", http.StatusUnauthorized},
+	}
+
+	for _, item := range tests {
+		id, err := verifyToken(context.Background(), item.token, issuers, now)
+		if item.code != 0 {
+			if errorStatus(err) != item.code {
+				t.Errorf("verifyToken(%s) error = %v Want: status %d", item.name, err, item.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("verifyToken(%s) error: %v", item.name, err)
+			continue
+		}
+		if id.Subject != "1234" || id.name() != "user@example.com" || id.Issuer != ti.URL {
+			t.Errorf("verifyToken(%s) = %+v Want: subject 1234 user@example.com", item.name, id)
+		}
+	}
+
+	// The keys are discovered once and cached. The unknown key id does not fetch them again within a minute.
+	if n := atomic.LoadInt32(&ti.fetches); n != 1 {
+		t.Errorf("the JWKS was fetched %d times Want: 1", n)
+	}
+
+	// A minute later the unknown key id refreshes the keys.
+	if _, err := verifyToken(context.Background(), tests[7].token, issuers, now.Add(2*time.Minute)); errorStatus(err) != http.StatusUnauthorized {
+		t.Errorf("verifyToken(key id) error = %v Want: 401 Unauthorized", err)
+	}
+	if n := atomic.LoadInt32(&ti.fetches); n != 2 {
+		t.Errorf("the JWKS was fetched %d times Want: 2", n)
+	}
+}
+
+func TestVerifyTokenEmailVerified(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+
+	now := time.Now()
+	issuers := []issuerConfig{{Issuer: ti.URL, Audiences: []string{"data-drive"}}}
+	var tests = []struct {
+		verified interface{}
+		want     string
+	}{
+		{true, "user@example.com"},
+		{"true", "user@example.com"},
+		{false, "sub:" + ti.URL + "/1234"},
+		{"false", "sub:" + ti.URL + "/1234"},
+		{nil, "sub:" + ti.URL + "/1234"},
+	}
+
+	for _, item := range tests {
+		claims := map[string]interface{}{
+			"iss": ti.URL, "aud": "data-drive", "sub": "1234", "email": "user@example.com", "exp": now.Add(time.Hour).Unix()}
+		if item.verified != nil {
+			claims["email_verified"] = item.verified
+		}
+		id, err := verifyToken(context.Background(), ti.sign(t, "RS256", "rsa1", claims), issuers, now)
+		if err != nil {
+			t.Errorf("verifyToken(email_verified %v) error: %v", item.verified, err)
+			continue
+		}
+		if id.name() != item.want {
+			t.Errorf("verifyToken(email_verified %v) name = %s Want: %s", item.verified, id.name(), item.want)
+		}
+	}
+}
+
+func TestVerifyTokenNoAudiences(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+
+	token := ti.sign(t, "RS256", "rsa1", map[string]interface{}{"iss": ti.URL, "aud": "x", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := verifyToken(context.Background(), token, []issuerConfig{{Issuer: ti.URL}}, time.Now()); errorStatus(err) != http.StatusInternalServerError {
+		t.Errorf("verifyToken() error = %v Want: a configuration error", err)
+	}
+}
+
+func TestFindIssuer(t *testing.T) {
+	issuers := []issuerConfig{{Issuer: googleIssuer}, {Issuer: "https://issuer.example.com"}}
+	for _, iss := range []string{"https://accounts.google.com", "accounts.google.com", "https://issuer.example.com"} {
+		if findIssuer(issuers, iss) == nil {
+			t.Errorf("findIssuer(%q) = nil Want: a trusted issuer", iss)
+		}
+	}
+	if findIssuer(issuers, "issuer.example.com") != nil {
+		t.Errorf("findIssuer(issuer.example.com) Want: nil")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+
+	cfg := &authConfig{Issuers: []issuerConfig{{Issuer: ti.URL, JWKSURL: ti.URL + "/jwks", Audiences: []string{"data-drive"}}}}
+	token := ti.sign(t, "RS256", "rsa1", map[string]interface{}{
+		"iss": ti.URL, "aud": "data-drive", "email": "user@example.com", "email_verified": true, "exp": time.Now().Add(time.Hour).Unix()})
+
+	req, _ := http.NewRequest("GET", "https://example.com/bq/p/d/v", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r, err := authenticate(req, cfg)
+	if err != nil {
+		t.Fatalf("authenticate() error: %v", err)
+	}
+	if id := requestIdentity(r.Context()); id == nil || id.Email != "user@example.com" {
+		t.Errorf("authenticate() identity = %+v Want: user@example.com", id)
+	}
+	if p, err := parseDDURL(r); err != nil || p.caller != "user@example.com" {
+		t.Errorf("parseDDURL() caller = %+v, %v Want: user@example.com", p, err)
+	}
+
+	req, _ = http.NewRequest("GET", "https://example.com/bq/p/d/v", nil)
+	if _, err := authenticate(req, cfg); errorStatus(err) != http.StatusUnauthorized {
+		t.Errorf("authenticate(no token) error = %v Want: 401 Unauthorized", err)
+	}
+
+	cfg.AllowAnonymous = true
+	if r, err := authenticate(req, cfg); err != nil || requestIdentity(r.Context()) != nil {
+		t.Errorf("authenticate(anonymous) = %v Want: an anonymous request", err)
+	}
+
+	if r, err := authenticate(req, &authConfig{}); err != nil || r != req {
+		t.Errorf("authenticate(no issuers) = %v Want: the request unchanged", err)
+	}
+}
+
+func TestAuthenticateIAP(t *testing.T) {
+	ti := newTestIssuer(t)
+	defer ti.Close()
+	defer func(u string) { iapJWKSURL = u }(iapJWKSURL)
+	iapJWKSURL = ti.URL + "/jwks"
+
+	const audience = "/projects/1/global/backendServices/2"
+	cfg := &authConfig{IAP: &iapConfig{Audience: audience}}
+	claims := func(aud string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": iapIssuer, "aud": aud, "sub": "accounts.google.com:1234", "email": "user@example.com",
+			"exp": time.Now().Add(time.Hour).Unix()}
+	}
+
+	var tests = []struct {
+		name      string
+		assertion string
+		code      int
+	}{
+		{"signed", ti.sign(t, "ES256", "ec1", claims(audience)), 0},
+		{"audience", ti.sign(t, "ES256", "ec1", claims("/projects/1/apps/other")), http.StatusUnauthorized},
+		{"tampered", ti.sign(t, "ES256", "ec1", claims(audience)) + "A", http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+
+	for _, item := range tests {
+		req, _ := http.NewRequest("GET", "https://example.com/bq/p/d/v", nil)
+		req.Header.Set("X-Goog-Authenticated-User-Email", "accounts.google.com:user@example.com")
+		if item.assertion != "" {
+			req.Header.Set(iapAssertionHeader, item.assertion)
+		}
+		r, err := authenticate(req, cfg)
+		if item.code != 0 {
+			if errorStatus(err) != item.code {
+				t.Errorf("authenticate(%s) error = %v Want: status %d", item.name, err, item.code)
+			}
+			continue
+		}
+		if err != nil || requestCaller(r) != "user@example.com" {
+			t.Errorf("authenticate(%s) = %v Want: user@example.com", item.name, err)
+		}
+	}
+}
+
+func TestGetJSONDataUnauthorized(t *testing.T) {
+	setConfig(&config{Auth: authConfig{Issuers: []issuerConfig{{Issuer: googleIssuer, Audiences: []string{"data-drive"}}}}})
+	defer setConfig(&config{})
+
+	w := httptest.NewRecorder()
+	GetJSONData(w, httptest.NewRequest("GET", "/bq/p/d/v", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("GetJSONData() = %d %v Want: 401 Unauthorized with a WWW-Authenticate header", w.Code, w.Header())
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want time.Duration
+	}{
+		{"public, max-age=19800, must-revalidate", 19800 * time.Second},
+		{"no-cache", defaultJWKSTTL},
+		{"", defaultJWKSTTL},
+	}
+	for _, item := range tests {
+		if have := maxAge(item.in); have != item.want {
+			t.Errorf("maxAge(%q) = %v Want: %v", item.in, have, item.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	// allUsers matches every caller, including anonymous callers.
+	allUsers = "allUsers"
+
+	// allAuthenticatedUsers matches every identified caller.
+	allAuthenticatedUsers = "allAuthenticatedUsers"
+
+	// groupPrefix marks a principal that matches the members of a group.
+	groupPrefix = "group:"
+
+	// apiKeyPrefix marks a principal that matches the requests made with an API key of the name.
+	apiKeyPrefix = "apikey:"
+
+	// subjectPrefix marks a caller identified by the issuer and subject of a token without a verified email.
+	subjectPrefix = "sub:"
+)
+
+// principal is the caller a request is authorized for.
+type principal struct {
+	// email is the verified email of the caller, or sub:{issuer}/{subject} when the email is not verified. It is empty
+	// for anonymous callers and callers with only an API key.
+	email string
+
+	// apiKey is the name of the API key of the request, if any. Keys are not identities, so they only match the
+	// apikey: principals.
+	apiKey string
+
+	// groups are the groups named in the groups claim of the bearer token.
+	groups []string
+}
+
+// requestPrincipal returns the caller of the request as verified from its bearer token or from the signed header of
+// Identity-Aware Proxy, and the API key it was made with.
+func requestPrincipal(r *http.Request) principal {
+	var p principal
+	if id := requestIdentity(r.Context()); id != nil {
+		p.email = id.name()
+		if gs, ok := id.Claims["groups"].([]interface{}); ok {
+			for _, g := range gs {
+				if s, ok := g.(string); ok {
+					p.groups = append(p.groups, s)
+				}
+			}
+		}
+	}
+	if k := requestAPIKey(r.Context()); k != nil {
+		p.apiKey = k.Name
+	}
+	return p
+}
+
+// authorize returns a 403 Forbidden error when the policy denies the request. In dry-run mode every decision is
+// logged and the request is always allowed. Bigquery paths that do not name plain identifiers are rejected with
+// 400 Bad Request first, so that the rules only match the tables that are queried.
+func authorize(r *http.Request, cfg *authzConfig) error {
+	if len(cfg.Rules) == 0 && !cfg.DenyByDefault {
+		return nil
+	}
+	if err := validateBQPath(r.URL.Path); err != nil {
+		return err
+	}
+
+	p := requestPrincipal(r)
+	allowed, reason := cfg.decide(p, r.Method, r.URL.Path)
+
+	caller := p.name()
+	switch {
+	case cfg.DryRun:
+		log.Printf("authz: dry run: %s %s by %s: allowed %v by %s", r.Method, r.URL.Path, caller, allowed, reason)
+		return nil
+	case !allowed:
+		log.Printf("authz: %s %s by %s: denied by %s", r.Method, r.URL.Path, caller, reason)
+		return &statusError{http.StatusForbidden, fmt.Errorf("%s may not %s %s", caller, r.Method, r.URL.Path)}
+	}
+	return nil
+}
+
+// decide evaluates the rules in order and returns the effect of the first rule that matches the request along with
+// a description of what decided it.
+func (c *authzConfig) decide(p principal, method, urlPath string) (bool, string) {
+	for i, rule := range c.Rules {
+		if !routeMatches(rule.Route, urlPath) || !methodMatches(rule.Methods, method) || !p.matches(rule.Principals) {
+			continue
+		}
+		return !strings.EqualFold(rule.Effect, "deny"), fmt.Sprintf("rule %d (%s)", i, rule.Route)
+	}
+	if c.DenyByDefault {
+		return false, "the default"
+	}
+	return true, "the default"
+}
+
+// methodMatches reports whether the method is one of the rule methods.
+func methodMatches(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		switch strings.ToLower(m) {
+		case "read":
+			if method == http.MethodGet || method == http.MethodHead {
+				return true
+			}
+		case "write":
+			if method == http.MethodPost || method == http.MethodPut || method == http.MethodDelete {
+				return true
+			}
+		default:
+			if strings.EqualFold(m, method) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// name returns the caller for the logs.
+func (p principal) name() string {
+	switch {
+	case p.email != "":
+		return p.email
+	case p.apiKey != "":
+		return apiKeyPrefix + p.apiKey
+	}
+	return "anonymous"
+}
+
+// matches reports whether the caller is one of the principals.
+func (p principal) matches(principals []string) bool {
+	for _, pr := range principals {
+		switch {
+		case pr == allUsers:
+			return true
+
+		case strings.HasPrefix(pr, apiKeyPrefix):
+			if p.apiKey != "" && principalMatches(strings.TrimPrefix(pr, apiKeyPrefix), p.apiKey) {
+				return true
+			}
+
+		case p.email == "":
+			continue
+
+		case pr == allAuthenticatedUsers:
+			return true
+
+		case strings.HasPrefix(pr, groupPrefix):
+			for _, g := range p.groups {
+				if principalMatches(strings.TrimPrefix(pr, groupPrefix), g) {
+					return true
+				}
+			}
+
+		case strings.HasPrefix(pr, subjectPrefix) || strings.HasPrefix(p.email, subjectPrefix):
+			// Subjects are chosen by their issuer, so they only match the principals naming them exactly.
+			if pr == p.email {
+				return true
+			}
+
+		default:
+			if principalMatches(pr, p.email) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// principalMatches reports whether the email matches the pattern, ignoring case. The pattern may use path.Match
+// wildcards.
+func principalMatches(pattern, email string) bool {
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(email))
+	return err == nil && ok
+}
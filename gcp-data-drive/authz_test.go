@@ -0,0 +1,140 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAuthzDecide(t *testing.T) {
+	c := &authzConfig{
+		DenyByDefault: true,
+		Rules: []authzRule{
+			{Route: "bq/proj/reporting/secret", Principals: []string{allUsers}, Effect: "deny"},
+			{Route: "bq/proj/reporting/*", Methods: []string{"read"}, Principals: []string{"group:analytics@example.com"}},
+			{Route: "fs/proj/events", Methods: []string{"write"}, Principals: []string{"*@etl.iam.gserviceaccount.com"}},
+			{Route: "bq/proj/public/*", Methods: []string{"GET"}, Principals: []string{allUsers}},
+			{Route: "fs/proj/*", Methods: []string{"read"}, Principals: []string{allAuthenticatedUsers}},
+			{Route: "bq/proj/hr/*", Principals: []string{"alice@corp.com", "sub:https://login.example.com/1234"}},
+			{Route: "bq/proj/partners/*", Principals: []string{"apikey:partner-*"}},
+			{Route: "bq/proj/shared/*", Principals: []string{"*"}},
+		},
+	}
+
+	analyst := principal{email: "ana@example.com", groups: []string{"analytics@example.com"}}
+	etl := principal{email: "loader@etl.iam.gserviceaccount.com"}
+	anonymous := principal{}
+	subject := principal{email: "sub:https://login.example.com/1234"}
+	chosen := principal{email: "sub:https://login.example.com/alice@corp.com"}
+	partner := principal{apiKey: "partner-a"}
+
+	var tests = []struct {
+		p      principal
+		method string
+		path   string
+		want   bool
+	}{
+		{analyst, "GET", "/bq/proj/reporting/sales", true},
+		{analyst, "POST", "/bq/proj/reporting/sales/_jobs", false},
+		{analyst, "GET", "/bq/proj/reporting/secret", false},
+		{etl, "GET", "/bq/proj/reporting/sales", false},
+		{etl, "POST", "/fs/proj/events", true},
+		{etl, "PUT", "/fs/proj/events/doc1", true},
+		{analyst, "POST", "/fs/proj/events", false},
+		{anonymous, "GET", "/bq/proj/public/v", true},
+		{anonymous, "GET", "/fs/proj/events", false},
+		{analyst, "GET", "/fs/proj/events", true},
+		{analyst, "GET", "/bq/other/d/v", false},
+		{subject, "GET", "/bq/proj/hr/v", true},
+		{subject, "GET", "/fs/proj/events", true},
+		{chosen, "GET", "/bq/proj/hr/v", false},
+		{principal{email: "sub:https://login.example.com/loader@etl.iam.gserviceaccount.com"}, "POST", "/fs/proj/events", false},
+		{partner, "GET", "/bq/proj/partners/v", true},
+		{partner, "GET", "/fs/proj/events", false},
+		{partner, "GET", "/bq/proj/shared/v", false},
+		{etl, "GET", "/bq/proj/shared/v", true},
+		{principal{apiKey: "internal"}, "GET", "/bq/proj/partners/v", false},
+		{etl, "GET", "/bq/proj/partners/v", false},
+	}
+
+	for _, item := range tests {
+		if have, reason := c.decide(item.p, item.method, item.path); have != item.want {
+			t.Errorf("decide(%+v, %s, %s) = %v by %s Want: %v", item.p, item.method, item.path, have, reason, item.want)
+		}
+	}
+
+	c.DenyByDefault = false
+	if have, _ := c.decide(analyst, "GET", "/bq/other/d/v"); !have {
+		t.Errorf("decide(unmatched) = false Want: true without deny by default")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	cfg := &authzConfig{
+		DenyByDefault: true,
+		Rules:         []authzRule{{Route: "bq/proj/*", Methods: []string{"read"}, Principals: []string{"ana@example.com"}}},
+	}
+
+	req := httptest.NewRequest("GET", "/bq/proj/d/v", nil)
+	req = req.WithContext(withIdentity(req.Context(), &identity{Email: "ana@example.com"}))
+	if err := authorize(req, cfg); err != nil {
+		t.Errorf("authorize(ana) error: %v", err)
+	}
+
+	// The unsigned header of Identity-Aware Proxy is not trusted.
+	req = httptest.NewRequest("GET", "/bq/proj/d/v", nil)
+	req.Header.Set("X-Goog-Authenticated-User-Email", "accounts.google.com:ana@example.com")
+	if err := authorize(req, cfg); errorStatus(err) != http.StatusForbidden {
+		t.Errorf("authorize(unsigned IAP header) error = %v Want: 403 Forbidden", err)
+	}
+
+	req = httptest.NewRequest("GET", "/bq/proj/d/v", nil)
+	if err := authorize(req, cfg); errorStatus(err) != http.StatusForbidden {
+		t.Errorf("authorize(anonymous) error = %v Want: 403 Forbidden", err)
+	}
+
+	cfg.DryRun = true
+	if err := authorize(req, cfg); err != nil {
+		t.Errorf("authorize(dry run) error: %v", err)
+	}
+
+	if err := authorize(req, &authzConfig{}); err != nil {
+		t.Errorf("authorize(no rules) error: %v", err)
+	}
+
+	// A rule allowing a dataset does not match a table name that breaks out of the query.
+	cfg = &authzConfig{Rules: []authzRule{
+		{Route: "bq/proj/public/*", Effect: "allow"},
+		{Route: "bq/*", Effect: "deny"},
+	}}
+	req = httptest.NewRequest("GET", "/bq/proj/public/"+url.PathEscape("v` where false) union all (select * from `proj.private.v`) -- "), nil)
+	if err := authorize(req, cfg); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("authorize(hostile table) error = %v Want: 400 Bad Request", err)
+	}
+}
+
+func TestGetJSONDataForbidden(t *testing.T) {
+	setConfig(&config{Authz: authzConfig{DenyByDefault: true}})
+	defer setConfig(&config{})
+
+	w := httptest.NewRecorder()
+	GetJSONData(w, httptest.NewRequest("GET", "/bq/p/d/v", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("GetJSONData() = %d Want: 403 Forbidden", w.Code)
+	}
+}
@@ -15,14 +15,27 @@
 package gcpdatadrive
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 )
 
 // bqDataPlatform contains the necessary information to connect and get data from BigQuery platfrom.
@@ -35,24 +48,89 @@ type bqDataPlatform struct {
 
 	// query is  a pointer to the BigQuery query struct which is composed from the dataQuery.
 	query *bigquery.Query
+
+	// encoder renders the rows using the result schema. When nil the rows are marshaled with encoding/json.
+	encoder *bqEncoder
+
+	// export is the Cloud Storage destination of the results. When nil the rows are returned in the response.
+	export *exportTarget
+
+	// budget limits the bytes billed by the query.
+	budget *bqBudget
+
+	// mask redacts the fields hidden from the caller before the rows are encoded.
+	mask *masker
+
+	// header reports the bytes processed by the query.
+	header http.Header
 }
 
 // getData contains the implementation detail for retriving and marshaling data from BigQuery into JSON.
 func (b *bqDataPlatform) getData(ctx context.Context) ([]byte, error) {
-	// Call the read function to get the BQ interator of the BigQuery rows.
-	it, err := b.query.Read(ctx)
+	// Queries over budget are rejected before they run.
+	if err := b.budget.check(ctx, b.query); err != nil {
+		return nil, err
+	}
+
+	// Large results can be exported to Cloud Storage instead of being held in memory.
+	if b.export != nil {
+		qctx, span := startSpan(ctx, "bigquery query")
+		job, err := b.query.Run(qctx)
+		if err == nil {
+			span.SetAttributes(attribute.String("bigquery.job_id", job.ID()))
+			err = waitJob(qctx, job)
+		}
+		endSpan(span, err)
+		if err != nil {
+			return nil, bqError(err)
+		}
+		b.header = bytesProcessed(job.LastStatus())
+		observeBQJob(ctx, job.LastStatus())
+		return b.export.exportBQ(ctx, job)
+	}
+
+	// Call the read function to get the BQ interator of the BigQuery rows. Read runs the job and waits for it.
+	qctx, span := startSpan(ctx, "bigquery query")
+	it, err := b.query.Read(qctx)
+	if err == nil && it.SourceJob() != nil {
+		span.SetAttributes(attribute.String("bigquery.job_id", it.SourceJob().ID()))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, bqError(err)
+	}
+
+	// Add the BigQuery rows to a slice for marshaling. The rows are held in memory, so large results are exported
+	// with export=gcs, optionally with a callback to be notified when the export is done.
+	rows, err := readBQRowsSpan(ctx, it, false)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a map to hold our BigQuery results.
-	res := []map[string]bigquery.Value{}
+	// The statistics of the job behind the iterator report the bytes processed.
+	if job := it.SourceJob(); job != nil {
+		st, err := finishedStatus(ctx, job)
+		if err != nil {
+			log.Printf("bigquery: reading the statistics of job %s: %v", job.ID(), err)
+		}
+		b.header = bytesProcessed(st)
+		observeBQJob(ctx, st)
+	}
+
+	return encodeBQRowsSpan(ctx, b.encoder, b.mask, it.Schema, rows)
+}
 
-	// Add the BigQuery rows to a slice of maps for marshaling.
-	// TODO: This implementation builds a slice of maps in memory. The dataset size must fit in memory. Consider
-	// providing callback fulfillment for large datasets leverging pub/sub and GCS.
+// headers reports the bytes processed by the query.
+func (b *bqDataPlatform) headers() http.Header {
+	return b.header
+}
+
+// readBQRows reads the rows from the iterator. When onePage is set reading stops at the end of the current page so
+// the page token of the iterator points at the next page.
+func readBQRows(it *bigquery.RowIterator, onePage bool) ([][]bigquery.Value, error) {
+	rows := [][]bigquery.Value{}
 	for {
-		row := make(map[string]bigquery.Value)
+		var row []bigquery.Value
 		err := it.Next(&row)
 
 		if err != nil {
@@ -61,10 +139,41 @@ func (b *bqDataPlatform) getData(ctx context.Context) ([]byte, error) {
 			}
 			return nil, err
 		}
-		res = append(res, row)
+		rows = append(rows, row)
+
+		if onePage && it.PageInfo().Remaining() == 0 {
+			break
+		}
 	}
+	return rows, nil
+}
 
-	return json.Marshal(&res)
+// finishedStatus returns the status of a finished job. The status the job was last read with is reused when it is
+// final, and otherwise the status is read again.
+func finishedStatus(ctx context.Context, job *bigquery.Job) (*bigquery.JobStatus, error) {
+	if st := job.LastStatus(); st != nil && st.Done() && st.Statistics != nil {
+		return st, nil
+	}
+	return job.Status(ctx)
+}
+
+// readBQRowsSpan reads the rows from the iterator in a span reporting the number of rows.
+func readBQRowsSpan(ctx context.Context, it *bigquery.RowIterator, onePage bool) ([][]bigquery.Value, error) {
+	_, span := startSpan(ctx, "bigquery read rows")
+	rows, err := readBQRows(it, onePage)
+	span.SetAttributes(attribute.Int("bigquery.rows", len(rows)))
+	endSpan(span, err)
+	return rows, err
+}
+
+// encodeBQRowsSpan masks and encodes the rows in a span reporting the size of the encoding.
+func encodeBQRowsSpan(ctx context.Context, enc *bqEncoder, mask *masker, schema bigquery.Schema, rows [][]bigquery.Value) ([]byte, error) {
+	_, span := startSpan(ctx, "bigquery encode")
+	schema, rows = mask.maskRows(schema, rows)
+	bts, err := enc.encodeRows(schema, rows)
+	span.SetAttributes(attribute.Int("datadrive.response_bytes", len(bts)))
+	endSpan(span, err)
+	return bts, err
 }
 
 // close will close the client connection to BigQuery
@@ -76,21 +185,68 @@ func (b *bqDataPlatform) close() error {
 }
 
 // newBQPlatform creates and populates the BigQuery platform client requirements and returns
-// a type that satisfies the dataplatform interface.
-func newBQPlatform(ctx context.Context, p *dataConnParam) (*bqDataPlatform, error) {
+// a type that satisfies the dataplatform interface. A project path lists its datasets and a
+// dataset path lists its tables. The path of a configured table-valued function calls it and the _predict path
+// below a model returns predictions.
+func newBQPlatform(ctx context.Context, p *dataConnParam) (dataPlatform, error) {
 	// Validate the connection params and return and error if they are not compatible.
 	if err := validateConnectionParams(p); err != nil {
 		return nil, err
 	}
 
-	// Create the BigQuery client.
-	c, err := bigquery.NewClient(ctx, p.connectionParams[0])
+	// Select the job options of the route matching the path.
+	cfg, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts, route := cfg.BigQuery.options(drivePath("bq", p.connectionParams...))
+
+	// Paths below the view's _jobs segment run the query asynchronously. Their paging parameters are checked before
+	// a client is created.
+	var jp *bqJobPlatform
+	if len(p.connectionParams) > 3 && p.connectionParams[3] == jobsParam {
+		if jp, err = newBQJobPlatform(p); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the BigQuery client with the credentials selected for the request.
+	copts, err := p.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	c, err := newBQClient(ctx, opts, p.connectionParams[0], copts...)
 	if err != nil {
 		return nil, err
 	}
 
+	// Project and dataset paths are discovery requests.
+	switch len(p.connectionParams) {
+	case 1:
+		return &bqDatasetList{
+			client:    c,
+			projectID: p.connectionParams[0],
+		}, nil
+
+	case 2:
+		return &bqTableList{
+			client:  c,
+			dataset: c.DatasetInProject(p.connectionParams[0], p.connectionParams[1]),
+		}, nil
+	}
+
+	// The _predict path below a model runs ML.PREDICT over the posted rows.
+	if len(p.connectionParams) == 4 && p.connectionParams[3] == predictParam {
+		enc, err := newBQEncoder(p.query)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return newBQPredictPlatform(c, opts, route, enc, p), nil
+	}
+
 	// Create an ANSI SQL Query string from the HTTP request path.
-	qs := fmt.Sprintf("select * from `%s`", strings.Join(p.connectionParams, "."))
+	qs := fmt.Sprintf("select * from `%s`", strings.Join(p.connectionParams[:3], "."))
 
 	// Create the BQ query
 	q := c.Query(qs)
@@ -98,19 +254,381 @@ func newBQPlatform(ctx context.Context, p *dataConnParam) (*bqDataPlatform, erro
 	// Set the standard SQL option
 	q.UseStandardSQL = true
 
+	// Paths of configured table-valued functions call the function with the arguments of the request.
+	function := cfg.BigQuery.function(drivePath("bq", p.connectionParams[:3]...))
+	if err := callBQRoutine(ctx, c, q, p, function); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Only the rows matching the claims of the caller are returned.
+	if err := filterBQQuery(q, p.filters); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Apply the job options and limit the bytes billed by the query.
+	if err := applyBQOptions(q, opts, route, p.caller); err != nil {
+		c.Close()
+		return nil, err
+	}
+	budget := newBQBudget(q, opts)
+
+	// Select the typed encoder requested with the types and geo query parameters.
+	enc, err := newBQEncoder(p.query)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if jp != nil {
+		jp.client, jp.query, jp.encoder, jp.budget = c, q, enc, budget
+		return jp, nil
+	}
+
+	// Select the Cloud Storage export requested with the export and format query parameters.
+	exp, err := newExportTarget(p.query, "json", "csv", "parquet")
+	if err == nil {
+		err = p.mask.exportError(exp)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
 	return &bqDataPlatform{
-		query:  q,
-		client: c,
+		query:   q,
+		client:  c,
+		encoder: enc,
+		export:  exp,
+		budget:  budget,
+		mask:    p.mask,
 	}, nil
 
 }
 
-// validateConnectionParams is a basic len check of the parameters
-// TODO: Add additional complex parsing to check the parameters.
+// newBQClient creates a BigQuery client that runs jobs in the billing project of the job options, which defaults to
+// project.
+func newBQClient(ctx context.Context, opts bqOptions, project string, copts ...option.ClientOption) (*bigquery.Client, error) {
+	billing := opts.BillingProject
+	if billing == "" {
+		billing = project
+	}
+	_, span := startSpan(ctx, "bigquery client", attribute.String("gcp.project_id", billing))
+	c, err := bigquery.NewClient(ctx, billing, copts...)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	clientsCreated.WithLabelValues("bigquery").Inc()
+	c.Location = opts.Location
+	return c, nil
+}
+
+// validateConnectionParams is a basic len check of the parameters. The project, dataset and table are then checked
+// to be identifiers before they are quoted into any query.
 func validateConnectionParams(p *dataConnParam) error {
-	// A basic check to make sure we have at least 3 parameters to work with.
-	if len(p.connectionParams) != 3 {
-		return errors.New("the url path must be in the form https://host/bq/project/dataset/view")
+	// A basic check to make sure we have between 1 and 3 parameters to work with, or a view followed by a jobs path,
+	// or a model followed by a predict path.
+	n := len(p.connectionParams)
+	predict := n == 4 && p.connectionParams[3] == predictParam
+	if n < 1 || n > 6 || n > 3 && p.connectionParams[3] != jobsParam && !predict || n == 6 && p.connectionParams[5] != resultsParam {
+		return &statusError{http.StatusBadRequest, errors.New("the url path must be in the form https://host/bq/project[/dataset[/view[/_jobs[/jobid[/results]]]]] or https://host/bq/project/dataset/model/_predict")}
+	}
+	for _, s := range p.connectionParams {
+		if s == "" {
+			return &statusError{http.StatusBadRequest, errors.New("the url path must not contain empty segments")}
+		}
+	}
+	return validateBQIdentifiers(p.connectionParams)
+}
+
+// validateBQPath checks the project, dataset and table of a Bigquery URL path. Other paths are left to their data
+// platform.
+func validateBQPath(urlPath string) error {
+	segs := strings.Split(strings.Trim(urlPath, "/"), "/")
+	if segs[0] != "bq" {
+		return nil
+	}
+	return validateBQIdentifiers(segs[1:])
+}
+
+// bqIdentifierRE matches the project, dataset and table names a path may name. Backticks, whitespace, parentheses
+// and comments can not be part of them, so they can not break out of a quoted table name.
+var bqIdentifierRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateBQIdentifiers rejects with 400 Bad Request the paths whose project, dataset or table are not plain
+// identifiers, or that hold a -- comment. Only the first three segments name BigQuery resources.
+func validateBQIdentifiers(segs []string) error {
+	if len(segs) > 3 {
+		segs = segs[:3]
+	}
+	for _, s := range segs {
+		if !bqIdentifierRE.MatchString(s) || strings.Contains(s, "--") {
+			return &statusError{http.StatusBadRequest, fmt.Errorf("%q is not a valid Bigquery project, dataset or table name", s)}
+		}
+	}
+	return nil
+}
+
+// bqEncoder renders BigQuery rows as JSON using the result schema so that every value keeps its type.
+type bqEncoder struct {
+	// jsSafe renders 64-bit integers and numerics as strings so they survive JavaScript's float64 numbers.
+	jsSafe bool
+
+	// geoJSON renders GEOGRAPHY values as GeoJSON objects instead of well-known text strings.
+	geoJSON bool
+}
+
+// newBQEncoder returns the encoder selected by the types (strict or js-safe) and geo (wkt or geojson)
+// query parameters. A nil encoder is returned when no types parameter is given.
+func newBQEncoder(q url.Values) (*bqEncoder, error) {
+	var e bqEncoder
+	switch q.Get("types") {
+	case "":
+		return nil, nil
+	case "strict":
+	case "js-safe":
+		e.jsSafe = true
+	default:
+		return nil, fmt.Errorf(`unknown types %q: "strict" and "js-safe" are supported`, q.Get("types"))
+	}
+
+	switch q.Get("geo") {
+	case "", "wkt":
+	case "geojson":
+		e.geoJSON = true
+	default:
+		return nil, fmt.Errorf(`unknown geo %q: "wkt" and "geojson" are supported`, q.Get("geo"))
+	}
+	return &e, nil
+}
+
+// encodeRows renders the rows as a JSON array of objects with the columns in schema order. A nil encoder
+// marshals the client values with encoding/json.
+func (e *bqEncoder) encodeRows(schema bigquery.Schema, rows [][]bigquery.Value) ([]byte, error) {
+	if e == nil {
+		res := make([]map[string]bigquery.Value, len(rows))
+		for i, row := range rows {
+			res[i] = bqRowMap(schema, row)
+		}
+		return json.Marshal(&res)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, row := range rows {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := e.encodeRecord(&buf, schema, row); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// bqRowMap converts a row into a map keyed by column name. Records become nested maps as they do when
+// the client loads a row into a map.
+func bqRowMap(schema bigquery.Schema, vals []bigquery.Value) map[string]bigquery.Value {
+	m := make(map[string]bigquery.Value, len(schema))
+	for i, f := range schema {
+		v := vals[i]
+		switch {
+		case v == nil || f.Schema == nil:
+		case !f.Repeated:
+			v = bqRowMap(f.Schema, v.([]bigquery.Value))
+		default:
+			vs := v.([]bigquery.Value)
+			recs := make([]bigquery.Value, len(vs))
+			for j, rec := range vs {
+				recs[j] = bqRowMap(f.Schema, rec.([]bigquery.Value))
+			}
+			v = recs
+		}
+		m[f.Name] = v
+	}
+	return m
+}
+
+// encodeRecord renders a row or RECORD value as a JSON object.
+func (e *bqEncoder) encodeRecord(buf *bytes.Buffer, schema bigquery.Schema, vals []bigquery.Value) error {
+	if len(vals) != len(schema) {
+		return fmt.Errorf("bigquery record has %d values for %d fields", len(vals), len(schema))
+	}
+	buf.WriteByte('{')
+	for i, f := range schema {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJSONString(buf, f.Name)
+		buf.WriteByte(':')
+		if err := e.encodeField(buf, f, vals[i]); err != nil {
+			return fmt.Errorf("field %s: %v", f.Name, err)
+		}
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+// encodeField renders a field value, expanding repeated fields into JSON arrays.
+func (e *bqEncoder) encodeField(buf *bytes.Buffer, f *bigquery.FieldSchema, v bigquery.Value) error {
+	if !f.Repeated || v == nil {
+		return e.encodeValue(buf, f, v)
+	}
+
+	vs, ok := v.([]bigquery.Value)
+	if !ok {
+		return fmt.Errorf("unexpected %T for a repeated field", v)
+	}
+	buf.WriteByte('[')
+	for i, item := range vs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := e.encodeValue(buf, f, item); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+// encodeValue renders a single non repeated value according to the field type.
+func (e *bqEncoder) encodeValue(buf *bytes.Buffer, f *bigquery.FieldSchema, v bigquery.Value) error {
+	if v == nil {
+		buf.WriteString("null")
+		return nil
+	}
+
+	switch f.Type {
+	case bigquery.RecordFieldType:
+		vs, ok := v.([]bigquery.Value)
+		if !ok {
+			return fmt.Errorf("unexpected %T for a RECORD", v)
+		}
+		return e.encodeRecord(buf, f.Schema, vs)
+
+	case bigquery.RangeFieldType:
+		r, ok := v.(*bigquery.RangeValue)
+		if !ok || f.RangeElementType == nil {
+			return fmt.Errorf("unexpected %T for a RANGE", v)
+		}
+		elem := &bigquery.FieldSchema{Type: f.RangeElementType.Type}
+		buf.WriteString(`{"start":`)
+		if err := e.encodeValue(buf, elem, r.Start); err != nil {
+			return err
+		}
+		buf.WriteString(`,"end":`)
+		if err := e.encodeValue(buf, elem, r.End); err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+		return nil
+	}
+
+	switch t := v.(type) {
+	case int64:
+		// Integers outside of +/-2^53 lose precision as JavaScript numbers.
+		if e.jsSafe {
+			writeJSONString(buf, strconv.FormatInt(t, 10))
+		} else {
+			buf.WriteString(strconv.FormatInt(t, 10))
+		}
+
+	case *big.Rat:
+		n := formatNumeric(t, f.Type)
+		if e.jsSafe {
+			writeJSONString(buf, n)
+		} else {
+			buf.WriteString(n)
+		}
+
+	case float64:
+		// JSON has no representation for NaN and the infinities so they are written as strings.
+		switch {
+		case math.IsNaN(t):
+			writeJSONString(buf, "NaN")
+		case math.IsInf(t, 1):
+			writeJSONString(buf, "Infinity")
+		case math.IsInf(t, -1):
+			writeJSONString(buf, "-Infinity")
+		default:
+			buf.WriteString(strconv.FormatFloat(t, 'g', -1, 64))
+		}
+
+	case bool:
+		buf.WriteString(strconv.FormatBool(t))
+
+	case []byte:
+		writeJSONString(buf, base64.StdEncoding.EncodeToString(t))
+
+	case time.Time:
+		writeJSONString(buf, t.UTC().Format(time.RFC3339Nano))
+
+	case civil.Date:
+		writeJSONString(buf, t.String())
+
+	case civil.Time:
+		writeJSONString(buf, bigquery.CivilTimeString(t))
+
+	case civil.DateTime:
+		writeJSONString(buf, t.Date.String()+"T"+bigquery.CivilTimeString(t.Time))
+
+	case *bigquery.IntervalValue:
+		writeJSONString(buf, t.String())
+
+	case string:
+		return e.encodeString(buf, f.Type, t)
+
+	default:
+		return fmt.Errorf("unsupported value type %T", v)
 	}
 	return nil
 }
+
+// encodeString renders the string backed types. JSON columns are embedded and GEOGRAPHY columns are
+// optionally converted to GeoJSON.
+func (e *bqEncoder) encodeString(buf *bytes.Buffer, typ bigquery.FieldType, s string) error {
+	switch {
+	case typ == bigquery.JSONFieldType && json.Valid([]byte(s)):
+		return json.Compact(buf, []byte(s))
+
+	case typ == bigquery.GeographyFieldType && e.geoJSON:
+		g, err := wktToGeoJSON(s)
+		if err != nil {
+			return err
+		}
+		bts, err := json.Marshal(g)
+		if err != nil {
+			return err
+		}
+		buf.Write(bts)
+		return nil
+	}
+
+	writeJSONString(buf, s)
+	return nil
+}
+
+// formatNumeric renders a NUMERIC or BIGNUMERIC value as an exact decimal without trailing zeros.
+func formatNumeric(r *big.Rat, typ bigquery.FieldType) string {
+	var s string
+	if typ == bigquery.BigNumericFieldType {
+		s = bigquery.BigNumericString(r)
+	} else {
+		s = bigquery.NumericString(r)
+	}
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// writeJSONString writes s to buf as a quoted JSON string.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	// Marshaling a string can not fail.
+	bts, _ := json.Marshal(s)
+	buf.Write(bts)
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+func TestBQEncoder(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "amount", Type: bigquery.NumericFieldType},
+		{Name: "big", Type: bigquery.BigNumericFieldType},
+		{Name: "day", Type: bigquery.DateFieldType},
+		{Name: "at", Type: bigquery.DateTimeFieldType},
+		{Name: "ts", Type: bigquery.TimestampFieldType},
+		{Name: "raw", Type: bigquery.BytesFieldType},
+		{Name: "doc", Type: bigquery.JSONFieldType},
+		{Name: "loc", Type: bigquery.GeographyFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "rec", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "ok", Type: bigquery.BooleanFieldType},
+		}},
+	}
+
+	row := []bigquery.Value{
+		int64(9007199254740993),
+		big.NewRat(3, 2),
+		big.NewRat(1, 4),
+		civil.Date{Year: 2024, Month: 1, Day: 2},
+		civil.DateTime{Date: civil.Date{Year: 2024, Month: 1, Day: 2}, Time: civil.Time{Hour: 3, Minute: 4, Second: 5}},
+		time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		[]byte("hi"),
+		`{"a": 1}`,
+		"POINT(1 2)",
+		[]bigquery.Value{"x", "y"},
+		[]bigquery.Value{true},
+	}
+
+	var tests = []struct {
+		in   string
+		want string
+	}{
+		{"types=strict",
+			`[{"id":9007199254740993,"amount":1.5,"big":0.25,"day":"2024-01-02","at":"2024-01-02T03:04:05",` +
+				`"ts":"2024-01-02T03:04:05Z","raw":"aGk=","doc":{"a":1},"loc":"POINT(1 2)","tags":["x","y"],"rec":{"ok":true}}]`,
+		},
+		{"types=js-safe&geo=geojson",
+			`[{"id":"9007199254740993","amount":"1.5","big":"0.25","day":"2024-01-02","at":"2024-01-02T03:04:05",` +
+				`"ts":"2024-01-02T03:04:05Z","raw":"aGk=","doc":{"a":1},"loc":{"coordinates":[1,2],"type":"Point"},"tags":["x","y"],"rec":{"ok":true}}]`,
+		},
+	}
+
+	for _, item := range tests {
+		q, _ := url.ParseQuery(item.in)
+		e, err := newBQEncoder(q)
+		if err != nil {
+			t.Fatalf("newBQEncoder(%v): unexpected error %v", item.in, err)
+		}
+
+		have, err := e.encodeRows(schema, [][]bigquery.Value{row})
+		if err != nil {
+			t.Fatalf("encodeRows(%v): unexpected error %v", item.in, err)
+		}
+		if string(have) != item.want {
+			t.Errorf("encodeRows(%v)\nHave:\n%s\nWant:\n%s", item.in, have, item.want)
+		}
+	}
+}
+
+func TestNewBQEncoder(t *testing.T) {
+	var tests = []struct {
+		in    string
+		isNil bool
+		isErr bool
+	}{
+		{"", true, false},
+		{"types=strict", false, false},
+		{"types=loose", true, true},
+		{"types=strict&geo=kml", true, true},
+	}
+
+	for _, item := range tests {
+		q, _ := url.ParseQuery(item.in)
+		e, err := newBQEncoder(q)
+		if (err != nil) != item.isErr {
+			t.Errorf("newBQEncoder(%v) error = %v, want error %v", item.in, err, item.isErr)
+		}
+		if (e == nil) != item.isNil {
+			t.Errorf("newBQEncoder(%v) = %v, want nil %v", item.in, e, item.isNil)
+		}
+	}
+}
+
+func TestBQEncoderDefault(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "rec", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "ok", Type: bigquery.BooleanFieldType},
+		}},
+	}
+	rows := [][]bigquery.Value{{int64(1), []bigquery.Value{true}}}
+
+	var e *bqEncoder
+	have, err := e.encodeRows(schema, rows)
+	if err != nil {
+		t.Fatalf("encodeRows(): unexpected error %v", err)
+	}
+
+	want := `[{"id":1,"rec":{"ok":true}}]`
+	if string(have) != want {
+		t.Errorf("encodeRows() = %s Want: %s", have, want)
+	}
+}
+
+func TestValidateBQIdentifiers(t *testing.T) {
+	var tests = []struct {
+		params []string
+		code   int
+	}{
+		{[]string{"my-project", "sales_2020", "daily-view"}, 0},
+		{[]string{"p", "d", "v", jobsParam, "job_123"}, 0},
+		{[]string{"p", "d", "m", predictParam}, 0},
+		{[]string{"p", "d", "v` where false) union all (select * from `p.d.v`) -- "}, http.StatusBadRequest},
+		{[]string{"p", "d", "v` where false) union all (select * from `p.d.v`) -- ", jobsParam}, http.StatusBadRequest},
+		{[]string{"p", "d`.`x", "v"}, http.StatusBadRequest},
+		{[]string{"p`", "d", "v"}, http.StatusBadRequest},
+		{[]string{"p", "d", "v w"}, http.StatusBadRequest},
+		{[]string{"p", "d", "f(1)"}, http.StatusBadRequest},
+		{[]string{"p", "d", "v--"}, http.StatusBadRequest},
+		{[]string{"p", "d", "v.w"}, http.StatusBadRequest},
+	}
+
+	for _, item := range tests {
+		err := validateConnectionParams(&dataConnParam{platform: "bq", connectionParams: item.params})
+		if item.code == 0 && err != nil || item.code != 0 && errorStatus(err) != item.code {
+			t.Errorf("validateConnectionParams(%q) error = %v Want: status %d", item.params, err, item.code)
+		}
+	}
+}
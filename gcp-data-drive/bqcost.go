@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// bytesProcessedHeader reports the bytes processed by the query behind a BigQuery response.
+	bytesProcessedHeader = "X-BigQuery-Bytes-Processed"
+
+	// bytesBilledLimitExceeded is the BigQuery error reason of queries that exceed their maximum bytes billed.
+	bytesBilledLimitExceeded = "bytesBilledLimitExceeded"
+)
+
+// bqBudget limits the bytes a query may bill.
+type bqBudget struct {
+	// maxBytes is the maximum bytes billed. Zero means no limit.
+	maxBytes int64
+
+	// dryRun estimates the bytes processed before the query runs.
+	dryRun bool
+}
+
+// newBQBudget applies the maximum bytes billed of the options to q and returns the budget.
+func newBQBudget(q *bigquery.Query, o bqOptions) *bqBudget {
+	q.MaxBytesBilled = o.MaxBytesBilled
+	return &bqBudget{
+		maxBytes: o.MaxBytesBilled,
+		dryRun:   o.DryRun != nil && *o.DryRun,
+	}
+}
+
+// check runs a dry run of the query when it is enabled and rejects the query when the estimated bytes exceed the
+// limit. Without a dry run BigQuery still fails the query once it would bill more than the limit.
+func (b *bqBudget) check(ctx context.Context, q *bigquery.Query) error {
+	if b == nil || !b.dryRun || b.maxBytes <= 0 {
+		return nil
+	}
+
+	dq := *q
+	dq.DryRun = true
+	job, err := dq.Run(ctx)
+	if err != nil {
+		return bqError(err)
+	}
+
+	st := job.LastStatus()
+	if st == nil || st.Statistics == nil {
+		return nil
+	}
+	if est := st.Statistics.TotalBytesProcessed; est > b.maxBytes {
+		return &statusError{http.StatusBadRequest, fmt.Errorf("the query would process an estimated %d bytes which exceeds the limit of %d bytes", est, b.maxBytes)}
+	}
+	return nil
+}
+
+// bqError returns err with a 400 Bad Request status when BigQuery rejected the query for exceeding its maximum
+// bytes billed.
+func bqError(err error) error {
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		for _, e := range ge.Errors {
+			if e.Reason == bytesBilledLimitExceeded {
+				return &statusError{http.StatusBadRequest, err}
+			}
+		}
+	}
+	var be *bigquery.Error
+	if errors.As(err, &be) && be.Reason == bytesBilledLimitExceeded {
+		return &statusError{http.StatusBadRequest, err}
+	}
+	return err
+}
+
+// bytesProcessed returns the header that reports the bytes processed by a finished job.
+func bytesProcessed(st *bigquery.JobStatus) http.Header {
+	if st == nil || st.Statistics == nil {
+		return nil
+	}
+	h := http.Header{}
+	h.Set(bytesProcessedHeader, strconv.FormatInt(st.Statistics.TotalBytesProcessed, 10))
+	return h
+}
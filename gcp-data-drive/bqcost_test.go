@@ -0,0 +1,106 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+func TestBQError(t *testing.T) {
+	var tests = []struct {
+		in   error
+		want int
+	}{
+		{&googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: bytesBilledLimitExceeded}}}, http.StatusBadRequest},
+		{&bigquery.Error{Reason: bytesBilledLimitExceeded}, http.StatusBadRequest},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "accessDenied"}}}, http.StatusInternalServerError},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+
+	for _, item := range tests {
+		if have := errorStatus(bqError(item.in)); have != item.want {
+			t.Errorf("errorStatus(bqError(%v)) = %d Want: %d", item.in, have, item.want)
+		}
+	}
+}
+
+func TestNewBQPlatformBudget(t *testing.T) {
+	dryRun := true
+	setConfig(&config{BigQuery: bigQueryConfig{
+		bqOptions: bqOptions{MaxBytesBilled: 1 << 30},
+		Routes:    []bqRoute{{Route: "bq/p/big/*", bqOptions: bqOptions{MaxBytesBilled: 1 << 20, DryRun: &dryRun}}},
+	}})
+	defer setConfig(&config{})
+
+	var tests = []struct {
+		in       string
+		maxBytes int64
+		dryRun   bool
+	}{
+		{"https://example.com/bq/p/big/v", 1 << 20, true},
+		{"https://example.com/bq/p/small/v", 1 << 30, false},
+		{"https://example.com/bq/p/big/v/_jobs", 1 << 20, true},
+	}
+
+	for _, item := range tests {
+		req, _ := http.NewRequest("GET", item.in, nil)
+		p, err := parseDDURL(req)
+		if err != nil {
+			t.Fatalf("parseDDURL(%q) error: %v", item.in, err)
+		}
+		pd, err := newBQPlatform(context.Background(), p)
+		if err != nil {
+			t.Fatalf("newBQPlatform(%q) error: %v", item.in, err)
+		}
+
+		var q *bigquery.Query
+		var b *bqBudget
+		switch v := pd.(type) {
+		case *bqDataPlatform:
+			q, b = v.query, v.budget
+		case *bqJobPlatform:
+			q, b = v.query, v.budget
+		}
+		if q.MaxBytesBilled != item.maxBytes || b.maxBytes != item.maxBytes || b.dryRun != item.dryRun {
+			t.Errorf("newBQPlatform(%q) = maxBytesBilled %d budget %+v Want: %d dryRun %v", item.in, q.MaxBytesBilled, b, item.maxBytes, item.dryRun)
+		}
+		pd.close()
+	}
+}
+
+func TestBQBudgetCheckDisabled(t *testing.T) {
+	// Without a dry run or a limit the query is never sent to BigQuery.
+	for _, b := range []*bqBudget{nil, {maxBytes: 10}, {dryRun: true}} {
+		if err := b.check(context.Background(), &bigquery.Query{}); err != nil {
+			t.Errorf("check() with budget %+v = %v Want: nil", b, err)
+		}
+	}
+}
+
+func TestBytesProcessed(t *testing.T) {
+	st := &bigquery.JobStatus{Statistics: &bigquery.JobStatistics{TotalBytesProcessed: 12345}}
+	if have := bytesProcessed(st).Get(bytesProcessedHeader); have != "12345" {
+		t.Errorf("bytesProcessed() = %q Want: 12345", have)
+	}
+	if have := bytesProcessed(&bigquery.JobStatus{}); have != nil {
+		t.Errorf("bytesProcessed() without statistics = %v Want: nil", have)
+	}
+}
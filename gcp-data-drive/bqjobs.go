@@ -0,0 +1,281 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"cloud.google.com/go/bigquery"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// jobsParam is the reserved path segment for asynchronous query jobs on a view.
+	jobsParam = "_jobs"
+
+	// resultsParam is the path segment below a job id that returns the job results.
+	resultsParam = "results"
+
+	// defaultPageSize is the number of rows returned per results page when maxResults is not given.
+	defaultPageSize = 1000
+)
+
+// bqJobPlatform starts BigQuery query jobs for a view and reports their status and results so that long running
+// views do not need to complete within a single request.
+type bqJobPlatform struct {
+	// client is a pointer to a BQ client.
+	client *bigquery.Client
+
+	// query is the view query run by new jobs.
+	query *bigquery.Query
+
+	// encoder renders the result rows. When nil the rows are marshaled with encoding/json.
+	encoder *bqEncoder
+
+	// budget limits the bytes billed by new jobs.
+	budget *bqBudget
+
+	// mask redacts the fields hidden from the caller before the result rows are encoded.
+	mask *masker
+
+	// jobsPath is the gcp-data-drive path of the view's _jobs segment.
+	jobsPath string
+
+	// jobID is the job addressed by the request. It is empty when starting a job.
+	jobID string
+
+	// location is the location of the job when it is not the client default.
+	location string
+
+	// results indicates the request is for the job results instead of the job status.
+	results bool
+
+	// pageSize and pageToken select the page of results.
+	pageSize  int
+	pageToken string
+
+	// code is the response status reported after the request has been fulfilled.
+	code int
+}
+
+// bqJobStatus is the response body describing a job.
+type bqJobStatus struct {
+	JobID               string        `json:"jobId"`
+	Location            string        `json:"location"`
+	State               string        `json:"state"`
+	TotalBytesProcessed int64         `json:"totalBytesProcessed"`
+	CacheHit            bool          `json:"cacheHit"`
+	Errors              []*bqJobError `json:"errors,omitempty"`
+
+	// Self is the gcp-data-drive path used to poll the job status.
+	Self string `json:"self"`
+
+	// Results is the gcp-data-drive path of the job results.
+	Results string `json:"results"`
+}
+
+// bqJobError is a single error reported by a job.
+type bqJobError struct {
+	Reason   string `json:"reason,omitempty"`
+	Location string `json:"location,omitempty"`
+	Message  string `json:"message"`
+}
+
+// bqJobResults is the response body holding a page of job results.
+type bqJobResults struct {
+	Rows          json.RawMessage `json:"rows"`
+	TotalRows     uint64          `json:"totalRows"`
+	NextPageToken string          `json:"nextPageToken,omitempty"`
+}
+
+// newBQJobPlatform parses the _jobs path below a view and its paging parameters. The client, query, encoder and
+// budget are set once the request is known to be valid.
+func newBQJobPlatform(p *dataConnParam) (*bqJobPlatform, error) {
+	j := &bqJobPlatform{
+		mask:      p.mask,
+		jobsPath:  drivePath("bq", p.connectionParams[:4]...),
+		location:  p.query.Get("location"),
+		pageSize:  defaultPageSize,
+		pageToken: p.query.Get("pageToken"),
+	}
+
+	if len(p.connectionParams) > 4 {
+		j.jobID = p.connectionParams[4]
+		j.results = len(p.connectionParams) > 5
+	}
+
+	if s := p.query.Get("maxResults"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("maxResults %q must be a positive integer", s)}
+		}
+		j.pageSize = n
+	}
+	return j, nil
+}
+
+// getData reports the status or the results of the job.
+func (j *bqJobPlatform) getData(ctx context.Context) ([]byte, error) {
+	if j.jobID == "" {
+		return nil, &statusError{http.StatusMethodNotAllowed, errors.New("use POST to start a job")}
+	}
+
+	job, err := j.lookupJob(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The status was read with the job by lookupJob.
+	st := job.LastStatus()
+	if !j.results {
+		return json.Marshal(j.jobStatus(job, st))
+	}
+
+	if !st.Done() {
+		return nil, &statusError{http.StatusConflict, fmt.Errorf("job %s is not done", job.ID())}
+	}
+	if err := st.Err(); err != nil {
+		return nil, bqError(err)
+	}
+
+	it, err := job.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	it.PageInfo().MaxSize = j.pageSize
+	it.PageInfo().Token = j.pageToken
+
+	rows, err := readBQRowsSpan(ctx, it, true)
+	if err != nil {
+		return nil, err
+	}
+	bts, err := encodeBQRowsSpan(ctx, j.encoder, j.mask, it.Schema, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(&bqJobResults{
+		Rows:          bts,
+		TotalRows:     it.TotalRows,
+		NextPageToken: it.PageInfo().Token,
+	})
+}
+
+// putData starts a new query job when a POST is made to the _jobs path.
+func (j *bqJobPlatform) putData(ctx context.Context, method string, body []byte) ([]byte, error) {
+	if j.jobID != "" || method != http.MethodPost {
+		return nil, &statusError{http.StatusMethodNotAllowed, errors.New("use POST on the _jobs path to start a job")}
+	}
+
+	// Queries over budget are rejected before a job is started.
+	if err := j.budget.check(ctx, j.query); err != nil {
+		return nil, err
+	}
+
+	qctx, span := startSpan(ctx, "bigquery start job")
+	job, err := j.query.Run(qctx)
+	if err == nil {
+		span.SetAttributes(attribute.String("bigquery.job_id", job.ID()))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, bqError(err)
+	}
+
+	j.code = http.StatusAccepted
+	return json.Marshal(j.jobStatus(job, job.LastStatus()))
+}
+
+// status returns 202 Accepted once a job has been started.
+func (j *bqJobPlatform) status() int {
+	return j.code
+}
+
+// lookupJob returns the requested job after checking it was started for this view. This stops a view path from
+// being used to read the results of unrelated jobs in the project.
+func (j *bqJobPlatform) lookupJob(ctx context.Context) (*bigquery.Job, error) {
+	location := j.location
+	if location == "" {
+		location = j.client.Location
+	}
+	job, err := j.client.JobFromIDLocation(ctx, j.jobID, location)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := job.Config()
+	if err != nil {
+		return nil, err
+	}
+	if qc, ok := cfg.(*bigquery.QueryConfig); !ok || qc.Q != j.query.Q || !rowFilterParamsMatch(qc.Parameters, j.query.Parameters) {
+		return nil, &statusError{http.StatusNotFound, fmt.Errorf("job %s was not started for this view", j.jobID)}
+	}
+	return job, nil
+}
+
+// jobStatus builds the status response body for the job.
+func (j *bqJobPlatform) jobStatus(job *bigquery.Job, st *bigquery.JobStatus) *bqJobStatus {
+	// The location is carried in the links so jobs outside the default location can be found.
+	var loc string
+	if job.Location() != "" {
+		loc = "?" + url.Values{"location": {job.Location()}}.Encode()
+	}
+
+	res := &bqJobStatus{
+		JobID:    job.ID(),
+		Location: job.Location(),
+		Self:     j.jobsPath + "/" + job.ID() + loc,
+		Results:  j.jobsPath + "/" + job.ID() + "/" + resultsParam + loc,
+	}
+	if st == nil {
+		res.State = "PENDING"
+		return res
+	}
+
+	switch st.State {
+	case bigquery.Pending:
+		res.State = "PENDING"
+	case bigquery.Running:
+		res.State = "RUNNING"
+	case bigquery.Done:
+		res.State = "DONE"
+	}
+
+	if st.Statistics != nil {
+		res.TotalBytesProcessed = st.Statistics.TotalBytesProcessed
+		if qs, ok := st.Statistics.Details.(*bigquery.QueryStatistics); ok {
+			res.CacheHit = qs.CacheHit
+		}
+	}
+
+	for _, e := range st.Errors {
+		res.Errors = append(res.Errors, &bqJobError{Reason: e.Reason, Location: e.Location, Message: e.Message})
+	}
+	if len(res.Errors) == 0 && st.Err() != nil {
+		res.Errors = append(res.Errors, &bqJobError{Message: st.Err().Error()})
+	}
+	return res
+}
+
+// close will close the client connection to BigQuery.
+func (j *bqJobPlatform) close() error {
+	return j.client.Close()
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	// routeLabel and callerLabel are the job labels that attribute a job to the route and the caller that ran it.
+	routeLabel  = "data_drive_route"
+	callerLabel = "data_drive_caller"
+
+	// maxLabelLength is the BigQuery limit on the length of label keys and values.
+	maxLabelLength = 63
+
+	// labelKeyPrefix starts the label keys that do not start with a letter.
+	labelKeyPrefix = "k_"
+)
+
+// applyBQOptions sets the job options of the query. The route name and the caller are added to the labels so the
+// jobs can be attributed in INFORMATION_SCHEMA.JOBS.
+func applyBQOptions(q *bigquery.Query, o bqOptions, route, caller string) error {
+	q.Location = o.Location
+	q.JobTimeout = time.Duration(o.JobTimeout)
+	q.DisableQueryCache = o.DisableQueryCache != nil && *o.DisableQueryCache
+
+	switch strings.ToLower(o.Priority) {
+	case "":
+	case "interactive":
+		q.Priority = bigquery.InteractivePriority
+	case "batch":
+		q.Priority = bigquery.BatchPriority
+	default:
+		return fmt.Errorf("unknown bigquery priority %q: interactive and batch are supported", o.Priority)
+	}
+
+	labels := map[string]string{}
+	for k, v := range o.Labels {
+		labels[bqLabelKey(k)] = bqLabel(v)
+	}
+	if route != "" {
+		labels[routeLabel] = bqLabel(route)
+	}
+	if caller != "" {
+		labels[callerLabel] = bqLabel(caller)
+	}
+	if len(labels) > 0 {
+		q.Labels = labels
+	}
+	return nil
+}
+
+// bqLabel converts s to a valid label value: lowercase letters, international characters, digits, underscores and
+// dashes of at most 63 characters. For example jane.doe@example.com becomes jane_doe_example_com.
+func bqLabel(s string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range strings.ToLower(s) {
+		if n == maxLabelLength {
+			break
+		}
+		if !bqLabelLetter(r) && (r < '0' || r > '9') && r != '_' && r != '-' {
+			r = '_'
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// bqLabelKey converts s to a valid label key, which is a label value that starts with a letter. Keys that do not are
+// prefixed with k_.
+func bqLabelKey(s string) string {
+	l := bqLabel(s)
+	if r, _ := utf8.DecodeRuneInString(l); l != "" && bqLabelLetter(r) {
+		return l
+	}
+	return bqLabel(labelKeyPrefix + l)
+}
+
+// bqLabelLetter reports whether r is a letter labels allow: a lowercase ASCII letter or an international letter that
+// is not uppercase.
+func bqLabelLetter(r rune) bool {
+	if r < utf8.RuneSelf {
+		return r >= 'a' && r <= 'z'
+	}
+	return unicode.IsLetter(r) && !unicode.IsUpper(r) && !unicode.IsTitle(r)
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestBQLabel(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want string
+	}{
+		{"jane.doe@example.com", "jane_doe_example_com"},
+		{"Sales-Report_1", "sales-report_1"},
+		{"", ""},
+		{strings.Repeat("a", 70), strings.Repeat("a", maxLabelLength)},
+	}
+
+	for _, item := range tests {
+		if have := bqLabel(item.in); have != item.want {
+			t.Errorf("bqLabel(%q) = %q Want: %q", item.in, have, item.want)
+		}
+	}
+}
+
+func TestBQLabelKey(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want string
+	}{
+		{"Team", "team"},
+		{"2020-report", "k_2020-report"},
+		{"_internal", "k__internal"},
+		{"-x", "k_-x"},
+		{"équipe", "équipe"},
+		{"部署", "部署"},
+		{"cost center", "cost_center"},
+		{"a١", "a_"},
+		{"", "k_"},
+		{strings.Repeat("1", 70), "k_" + strings.Repeat("1", maxLabelLength-2)},
+	}
+
+	for _, item := range tests {
+		if have := bqLabelKey(item.in); have != item.want {
+			t.Errorf("bqLabelKey(%q) = %q Want: %q", item.in, have, item.want)
+		}
+	}
+}
+
+func TestApplyBQOptions(t *testing.T) {
+	disable := true
+	o := bqOptions{
+		Location:          "EU",
+		Labels:            map[string]string{"Team": "Sales"},
+		Priority:          "Batch",
+		DisableQueryCache: &disable,
+		JobTimeout:        duration(time.Minute),
+	}
+
+	q := &bigquery.Query{}
+	if err := applyBQOptions(q, o, "reporting", "user@example.com"); err != nil {
+		t.Fatalf("applyBQOptions() error: %v", err)
+	}
+	want := map[string]string{"team": "sales", routeLabel: "reporting", callerLabel: "user_example_com"}
+	if q.Location != "EU" || q.Priority != bigquery.BatchPriority || !q.DisableQueryCache || q.JobTimeout != time.Minute ||
+		!reflect.DeepEqual(q.Labels, want) {
+		t.Errorf("applyBQOptions() = %+v Want: the options applied with labels %v", q.QueryConfig, want)
+	}
+
+	q = &bigquery.Query{}
+	if err := applyBQOptions(q, bqOptions{}, "", ""); err != nil || q.Labels != nil || q.Priority != "" {
+		t.Errorf("applyBQOptions() = %+v, %v Want: no options", q.QueryConfig, err)
+	}
+
+	if err := applyBQOptions(&bigquery.Query{}, bqOptions{Priority: "urgent"}, "", ""); err == nil {
+		t.Errorf("applyBQOptions(urgent): An error was expected but no error was returned")
+	}
+}
+
+func TestBigQueryRouteOptions(t *testing.T) {
+	var c config
+	if err := json.Unmarshal([]byte(`{"bigquery": {
+		"billingProject": "billing",
+		"labels": {"team": "data", "env": "prod"},
+		"routes": [
+			{"route": "bq/p/reporting/*", "name": "reporting", "location": "EU", "labels": {"team": "sales"}, "priority": "batch", "jobTimeout": "30s"}
+		]}}`), &c); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+
+	have, route := c.BigQuery.options("/bq/p/reporting/v")
+	if route != "reporting" || have.BillingProject != "billing" || have.Location != "EU" || have.Priority != "batch" ||
+		time.Duration(have.JobTimeout) != 30*time.Second ||
+		!reflect.DeepEqual(have.Labels, map[string]string{"team": "sales", "env": "prod"}) {
+		t.Errorf("options(reporting) = %+v, %q Want: the route options merged over the global options", have, route)
+	}
+	if c.BigQuery.Labels["team"] != "data" {
+		t.Errorf("options(reporting) changed the global labels to %v", c.BigQuery.Labels)
+	}
+
+	if have, route := c.BigQuery.options("/bq/p/raw/v"); route != "" || have.Location != "" {
+		t.Errorf("options(raw) = %+v, %q Want: the global options", have, route)
+	}
+}
+
+func TestNewBQPlatformOptions(t *testing.T) {
+	setConfig(&config{BigQuery: bigQueryConfig{
+		bqOptions: bqOptions{BillingProject: "billing", Location: "US"},
+		Routes:    []bqRoute{{Route: "bq/p/d/*", Name: "d"}},
+	}})
+	defer setConfig(&config{})
+
+	req, _ := http.NewRequest("GET", "https://example.com/bq/p/d/v", nil)
+	req = req.WithContext(withIdentity(req.Context(), &identity{Email: "user@example.com"}))
+	p, err := parseDDURL(req)
+	if err != nil {
+		t.Fatalf("parseDDURL() error: %v", err)
+	}
+	pd, err := newBQPlatform(context.Background(), p)
+	if err != nil {
+		t.Fatalf("newBQPlatform() error: %v", err)
+	}
+	bq := pd.(*bqDataPlatform)
+	defer bq.client.Close()
+
+	if bq.client.Project() != "billing" || bq.client.Location != "US" {
+		t.Errorf("newBQPlatform() client in %q %q Want: billing US", bq.client.Project(), bq.client.Location)
+	}
+	want := map[string]string{routeLabel: "d", callerLabel: "user_example_com"}
+	if !reflect.DeepEqual(bq.query.Labels, want) {
+		t.Errorf("newBQPlatform() labels = %v Want: %v", bq.query.Labels, want)
+	}
+}
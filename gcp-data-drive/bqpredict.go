@@ -0,0 +1,207 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// predictParam is the reserved path segment below a BigQuery ML model that returns ML.PREDICT output for the rows
+// in the request body.
+const predictParam = "_predict"
+
+// bqPredictPlatform runs ML.PREDICT over the JSON rows posted to a model's _predict path.
+type bqPredictPlatform struct {
+	// client is a pointer to a BQ client.
+	client *bigquery.Client
+
+	// model is the BigQuery ML model named by the path.
+	model *bigquery.Model
+
+	// opts, route and caller set the options of the prediction query.
+	opts   bqOptions
+	route  string
+	caller string
+
+	// encoder renders the prediction rows. When nil the rows are marshaled with encoding/json.
+	encoder *bqEncoder
+
+	// mask redacts the fields hidden from the caller.
+	mask *masker
+
+	// header reports the bytes processed by the prediction query.
+	header http.Header
+}
+
+// newBQPredictPlatform returns the platform for the _predict path below a model.
+func newBQPredictPlatform(c *bigquery.Client, opts bqOptions, route string, enc *bqEncoder, p *dataConnParam) *bqPredictPlatform {
+	return &bqPredictPlatform{
+		client:  c,
+		model:   c.DatasetInProject(p.connectionParams[0], p.connectionParams[1]).Model(p.connectionParams[2]),
+		opts:    opts,
+		route:   route,
+		caller:  p.caller,
+		encoder: enc,
+		mask:    p.mask,
+	}
+}
+
+// getData is not supported. Predictions are requested with POST.
+func (m *bqPredictPlatform) getData(ctx context.Context) ([]byte, error) {
+	return nil, &statusError{http.StatusMethodNotAllowed, errors.New("use POST with a JSON array of rows to request predictions")}
+}
+
+// putData validates the posted rows against the feature columns of the model and returns the ML.PREDICT output.
+func (m *bqPredictPlatform) putData(ctx context.Context, method string, body []byte) ([]byte, error) {
+	if method != http.MethodPost {
+		return nil, &statusError{http.StatusMethodNotAllowed, errors.New("use POST with a JSON array of rows to request predictions")}
+	}
+
+	// Decode the rows keeping numbers exact.
+	var rows []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&rows); err != nil {
+		return nil, &statusError{http.StatusBadRequest, fmt.Errorf("the request body must be a JSON array of objects: %v", err)}
+	}
+	if len(rows) == 0 {
+		return nil, &statusError{http.StatusBadRequest, errors.New("the request body has no rows")}
+	}
+
+	// Look up the feature schema of the model.
+	md, err := m.model.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	features, err := md.RawFeatureColumns()
+	if err != nil {
+		return nil, err
+	}
+
+	param, err := predictRows(features, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rows are passed as an array of structs and unnested into the input table of ML.PREDICT.
+	q := m.client.Query(fmt.Sprintf("select * from ML.PREDICT(MODEL `%s.%s.%s`, (select * from unnest(@rows)))",
+		m.model.ProjectID, m.model.DatasetID, m.model.ModelID))
+	q.UseStandardSQL = true
+	q.Parameters = []bigquery.QueryParameter{{Name: "rows", Value: param}}
+
+	// Apply the job options and limit the bytes billed by the query.
+	if err := applyBQOptions(q, m.opts, m.route, m.caller); err != nil {
+		return nil, err
+	}
+
+	// The prediction is read like any other query.
+	d := &bqDataPlatform{
+		client:  m.client,
+		query:   q,
+		encoder: m.encoder,
+		budget:  newBQBudget(q, m.opts),
+		mask:    m.mask,
+	}
+	bts, err := d.getData(ctx)
+	m.header = d.header
+	return bts, err
+}
+
+// predictRows converts the rows into an ARRAY<STRUCT> query parameter with one field per feature column. Every row
+// must set every feature and nothing else. Null values are passed as typed nulls.
+func predictRows(features []*bigquery.StandardSQLField, rows []map[string]interface{}) (*bigquery.QueryParameterValue, error) {
+	known := map[string]bool{}
+	for _, f := range features {
+		known[f.Name] = true
+		if f.Type == nil || f.Type.TypeKind == "" || f.Type.TypeKind == "ARRAY" || f.Type.TypeKind == "STRUCT" {
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("feature %q has a type that is not supported", f.Name)}
+		}
+	}
+
+	vals := make([]bigquery.QueryParameterValue, len(rows))
+	for i, row := range rows {
+		var unknown []string
+		for k := range row {
+			if !known[k] {
+				unknown = append(unknown, k)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("row %d: unknown features: %s", i, strings.Join(unknown, ", "))}
+		}
+
+		fields := make(map[string]bigquery.QueryParameterValue, len(features))
+		for _, f := range features {
+			v, ok := row[f.Name]
+			if !ok {
+				return nil, &statusError{http.StatusBadRequest, fmt.Errorf("row %d: feature %q is missing", i, f.Name)}
+			}
+			pv, err := featureValue(f, v)
+			if err != nil {
+				return nil, &statusError{http.StatusBadRequest, fmt.Errorf("row %d: feature %q: %v", i, f.Name, err)}
+			}
+			fields[f.Name] = *pv
+		}
+		vals[i] = bigquery.QueryParameterValue{StructValue: fields}
+	}
+
+	return &bigquery.QueryParameterValue{
+		Type: bigquery.StandardSQLDataType{
+			ArrayElementType: &bigquery.StandardSQLDataType{
+				StructType: &bigquery.StandardSQLStructType{Fields: features},
+			},
+		},
+		ArrayValue: vals,
+	}, nil
+}
+
+// featureValue coerces a decoded JSON value to the type of the feature column.
+func featureValue(f *bigquery.StandardSQLField, v interface{}) (*bigquery.QueryParameterValue, error) {
+	var s string
+	switch t := v.(type) {
+	case nil:
+		return &bigquery.QueryParameterValue{Type: *f.Type, Value: bigquery.NullString{}}, nil
+	case string:
+		s = t
+	case json.Number:
+		s = t.String()
+	case bool:
+		s = strconv.FormatBool(t)
+	default:
+		return nil, fmt.Errorf("unexpected %T", v)
+	}
+	return queryParamValue(queryParam{Name: f.Name, Type: f.Type.TypeKind}, s)
+}
+
+// headers reports the bytes processed by the prediction query.
+func (m *bqPredictPlatform) headers() http.Header {
+	return m.header
+}
+
+// close will close the client connection to BigQuery
+func (m *bqPredictPlatform) close() error {
+	return m.client.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestPredictRows(t *testing.T) {
+	features := []*bigquery.StandardSQLField{
+		{Name: "region", Type: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
+		{Name: "visits", Type: &bigquery.StandardSQLDataType{TypeKind: "INT64"}},
+	}
+
+	decode := func(s string) []map[string]interface{} {
+		var rows []map[string]interface{}
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.UseNumber()
+		if err := dec.Decode(&rows); err != nil {
+			t.Fatalf("Decode(%s) error: %v", s, err)
+		}
+		return rows
+	}
+
+	have, err := predictRows(features, decode(`[{"region": "EU", "visits": 3}, {"region": null, "visits": "4"}]`))
+	if err != nil {
+		t.Fatalf("predictRows() error: %v", err)
+	}
+	if len(have.ArrayValue) != 2 || have.Type.ArrayElementType == nil || have.Type.ArrayElementType.StructType == nil {
+		t.Fatalf("predictRows() = %+v Want: an array of 2 structs", have)
+	}
+	if v := have.ArrayValue[0].StructValue["visits"].Value; v != "3" {
+		t.Errorf("predictRows() visits = %v Want: 3", v)
+	}
+	if v := have.ArrayValue[1].StructValue["region"].Value; v != (bigquery.NullString{}) {
+		t.Errorf("predictRows() region = %v Want: a null value", v)
+	}
+
+	var tests = []string{
+		`[{"region": "EU"}]`,
+		`[{"region": "EU", "visits": 3, "extra": 1}]`,
+		`[{"region": "EU", "visits": 3.5}]`,
+		`[{"region": "EU", "visits": [3]}]`,
+	}
+	for _, item := range tests {
+		if _, err := predictRows(features, decode(item)); errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("predictRows(%s) error = %v Want: 400 Bad Request", item, err)
+		}
+	}
+}
+
+func TestNewBQPredictPlatform(t *testing.T) {
+	req, _ := http.NewRequest("POST", "https://example.com/bq/p/d/m/_predict", nil)
+	p, err := parseDDURL(req)
+	if err != nil {
+		t.Fatalf("parseDDURL() error: %v", err)
+	}
+	pd, err := newBQPlatform(context.Background(), p)
+	if err != nil {
+		t.Fatalf("newBQPlatform() error: %v", err)
+	}
+	defer pd.close()
+
+	m, ok := pd.(*bqPredictPlatform)
+	if !ok {
+		t.Fatalf("newBQPlatform() = %T Want: *gcpdatadrive.bqPredictPlatform", pd)
+	}
+	if m.model.ProjectID != "p" || m.model.DatasetID != "d" || m.model.ModelID != "m" {
+		t.Errorf("newBQPlatform() model = %+v Want: p.d.m", m.model)
+	}
+
+	if _, err := m.getData(context.Background()); errorStatus(err) != http.StatusMethodNotAllowed {
+		t.Errorf("getData() error = %v Want: 405 Method Not Allowed", err)
+	}
+	for _, body := range []string{`{"region": "EU"}`, `[]`} {
+		if _, err := m.putData(context.Background(), http.MethodPost, []byte(body)); errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("putData(%s) error = %v Want: 400 Bad Request", body, err)
+		}
+	}
+
+	p.connectionParams = []string{"p", "d", "m", predictParam, "x"}
+	if err := validateConnectionParams(p); err == nil {
+		t.Errorf("validateConnectionParams(%v): An error was expected but no error was returned", p.connectionParams)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// tableValuedFunction is the BigQuery routine type of table-valued functions.
+const tableValuedFunction = "TABLE_VALUED_FUNCTION"
+
+// bqReservedParams are the url query parameters that tune how a BigQuery path is read. The other parameters are the
+// arguments of a table-valued function, and are ignored for views.
+var bqReservedParams = map[string]bool{
+	"types":      true,
+	"geo":        true,
+	"export":     true,
+	"format":     true,
+	"callback":   true,
+	"location":   true,
+	"maxResults": true,
+	"pageToken":  true,
+}
+
+// bqRoutineArgs returns the url query parameters that are not reserved.
+func bqRoutineArgs(query url.Values) url.Values {
+	args := url.Values{}
+	for k, v := range query {
+		if !bqReservedParams[k] {
+			args[k] = v
+		}
+	}
+	return args
+}
+
+// callBQRoutine turns q into a call of the table-valued function named by the path when function is set. The
+// arguments are coerced to the types declared by the routine and passed as query parameters. Otherwise q is left
+// selecting from the view and the parameters that are not reserved, such as cache busters, are ignored.
+func callBQRoutine(ctx context.Context, c *bigquery.Client, q *bigquery.Query, p *dataConnParam, function bool) error {
+	if !function {
+		return nil
+	}
+	args := bqRoutineArgs(p.query)
+
+	// Look up the signature of the routine.
+	r := c.DatasetInProject(p.connectionParams[0], p.connectionParams[1]).Routine(p.connectionParams[2])
+	md, err := r.Metadata(ctx)
+	var ge *googleapi.Error
+	if errors.As(err, &ge) && ge.Code == http.StatusNotFound {
+		return &statusError{http.StatusNotFound, fmt.Errorf("table-valued function %s not found", strings.Join(p.connectionParams[:3], "."))}
+	}
+	if err != nil {
+		return err
+	}
+	if md.Type != tableValuedFunction {
+		return &statusError{http.StatusBadRequest, fmt.Errorf("routine %s is a %s: only table-valued functions can be called", p.connectionParams[2], md.Type)}
+	}
+
+	params, err := routineParams(md.Arguments, args)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i] = "@" + param.Name
+	}
+	q.Q = fmt.Sprintf("select * from `%s`(%s)", strings.Join(p.connectionParams[:3], "."), strings.Join(names, ", "))
+	q.Parameters = params
+	return nil
+}
+
+// routineParams coerces the arguments to the types of the routine arguments. Missing, unknown and invalid arguments
+// are rejected with 400 Bad Request.
+func routineParams(declared []*bigquery.RoutineArgument, args url.Values) ([]bigquery.QueryParameter, error) {
+	params := make([]bigquery.QueryParameter, 0, len(declared))
+	known := map[string]bool{}
+	for _, a := range declared {
+		known[a.Name] = true
+		if a.DataType == nil || a.DataType.TypeKind == "" || a.DataType.TypeKind == "ARRAY" || a.DataType.TypeKind == "STRUCT" {
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("argument %q has a type that can not be given in a url", a.Name)}
+		}
+
+		vs, ok := args[a.Name]
+		if !ok || len(vs) == 0 {
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("argument %q is required", a.Name)}
+		}
+		v, err := queryParamValue(queryParam{Name: a.Name, Type: a.DataType.TypeKind}, vs[0])
+		if err != nil {
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("argument %q: %v", a.Name, err)}
+		}
+		params = append(params, bigquery.QueryParameter{Name: a.Name, Value: v})
+	}
+
+	var unknown []string
+	for k := range args {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, &statusError{http.StatusBadRequest, fmt.Errorf("unknown arguments: %s", strings.Join(unknown, ", "))}
+	}
+	return params, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestBQRoutineArgs(t *testing.T) {
+	in := url.Values{"region": {"EU"}, "types": {"strict"}, "export": {"gcs"}, "since": {"2024-01-01"}}
+	want := url.Values{"region": {"EU"}, "since": {"2024-01-01"}}
+	if have := bqRoutineArgs(in); !reflect.DeepEqual(have, want) {
+		t.Errorf("bqRoutineArgs(%v) = %v Want: %v", in, have, want)
+	}
+}
+
+func TestRoutineParams(t *testing.T) {
+	declared := []*bigquery.RoutineArgument{
+		{Name: "region", DataType: &bigquery.StandardSQLDataType{TypeKind: "STRING"}},
+		{Name: "min_total", DataType: &bigquery.StandardSQLDataType{TypeKind: "INT64"}},
+	}
+
+	have, err := routineParams(declared, url.Values{"region": {"EU"}, "min_total": {"100"}})
+	if err != nil {
+		t.Fatalf("routineParams() error: %v", err)
+	}
+	want := []bigquery.QueryParameter{
+		{Name: "region", Value: &bigquery.QueryParameterValue{Type: bigquery.StandardSQLDataType{TypeKind: "STRING"}, Value: "EU"}},
+		{Name: "min_total", Value: &bigquery.QueryParameterValue{Type: bigquery.StandardSQLDataType{TypeKind: "INT64"}, Value: "100"}},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("routineParams() = %+v Want: %+v", have, want)
+	}
+
+	var tests = []struct {
+		declared []*bigquery.RoutineArgument
+		args     url.Values
+	}{
+		{declared, url.Values{"region": {"EU"}}},
+		{declared, url.Values{"region": {"EU"}, "min_total": {"lots"}}},
+		{declared, url.Values{"region": {"EU"}, "min_total": {"1"}, "extra": {"x"}}},
+		{[]*bigquery.RoutineArgument{{Name: "ids", DataType: &bigquery.StandardSQLDataType{
+			TypeKind: "ARRAY", ArrayElementType: &bigquery.StandardSQLDataType{TypeKind: "INT64"}}}}, url.Values{"ids": {"1"}}},
+	}
+
+	for _, item := range tests {
+		if _, err := routineParams(item.declared, item.args); errorStatus(err) != http.StatusBadRequest {
+			t.Errorf("routineParams(%v) error = %v Want: 400 Bad Request", item.args, err)
+		}
+	}
+}
+
+func TestCallBQRoutineView(t *testing.T) {
+	p := &dataConnParam{platform: "bq", connectionParams: []string{"p", "d", "v"}}
+
+	// A view is read without looking up a routine, and the parameters that are not reserved are ignored.
+	for _, v := range []url.Values{{"types": {"strict"}}, {"_": {"123"}, "types": {"strict"}}} {
+		p.query = v
+		q := &bigquery.Query{QueryConfig: bigquery.QueryConfig{Q: "select * from `p.d.v`"}}
+		if err := callBQRoutine(context.Background(), nil, q, p, false); err != nil || q.Q != "select * from `p.d.v`" || len(q.Parameters) != 0 {
+			t.Errorf("callBQRoutine(%v) = %q, %v Want: the view unchanged", p.query, q.Q, err)
+		}
+	}
+}
+
+func TestBigQueryFunctions(t *testing.T) {
+	cfg := &bigQueryConfig{Functions: []string{"/bq/p/d/orders_since", "/bq/p/tvfs/*"}}
+
+	var tests = []struct {
+		in   string
+		want bool
+	}{
+		{"/bq/p/d/orders_since", true},
+		{"/bq/p/tvfs/any", true},
+		{"/bq/p/d/orders", false},
+	}
+
+	for _, item := range tests {
+		if have := cfg.function(item.in); have != item.want {
+			t.Errorf("function(%s) = %v Want: %v", item.in, have, item.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheEntries is the number of responses held in memory when cache.maxEntries is not configured.
+const defaultCacheEntries = 1000
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	body    []byte
+	header  http.Header
+	etag    string
+	expires time.Time
+}
+
+// newCacheEntry builds the response entry for body and computes its strong ETag.
+func newCacheEntry(body []byte, header http.Header) *cacheEntry {
+	sum := sha256.Sum256(body)
+	return &cacheEntry{
+		body:   body,
+		header: header,
+		etag:   `"` + hex.EncodeToString(sum[:16]) + `"`,
+	}
+}
+
+// cacheParam is the reserved first path segment of cache invalidation requests.
+const cacheParam = "_cache"
+
+// responseStore holds cached responses. The in-process cache serves a single instance while the Redis store is shared
+// by every instance of the deployment. Store errors are logged by the caller and never fail the request.
+type responseStore interface {
+	// load returns the unexpired entry for key or nil.
+	load(ctx context.Context, key string) (*cacheEntry, error)
+
+	// store keeps the entry for key during ttl. Entries larger than the configured limit are not stored.
+	store(ctx context.Context, key string, e *cacheEntry, ttl time.Duration) error
+
+	// invalidate drops the entries of the path prefix and of every path below it.
+	invalidate(ctx context.Context, prefix string) error
+}
+
+// keyUnder reports whether the cache key belongs to the path prefix or to a path below it.
+func keyUnder(key, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	rest := key[len(prefix):]
+	return rest == "" || rest[0] == '/' || rest[0] == '?'
+}
+
+// responseCache is an in-process cache of responses keyed by the normalized request path and query.
+type responseCache struct {
+	mu         sync.Mutex
+	entries    map[string]*cacheEntry
+	maxEntries int
+
+	// maxBytes limits the size of the stored bodies. Zero means no limit.
+	maxBytes int
+}
+
+// newResponseCache returns an empty cache that holds up to maxEntries responses.
+func newResponseCache(maxEntries, maxBytes int) *responseCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	return &responseCache{entries: map[string]*cacheEntry{}, maxEntries: maxEntries, maxBytes: maxBytes}
+}
+
+// load returns the unexpired entry for key or nil.
+func (c *responseCache) load(ctx context.Context, key string) (*cacheEntry, error) {
+	return c.get(key, time.Now()), nil
+}
+
+// store keeps a copy of the entry that expires after ttl.
+func (c *responseCache) store(ctx context.Context, key string, e *cacheEntry, ttl time.Duration) error {
+	if c.maxBytes > 0 && len(e.body) > c.maxBytes {
+		return nil
+	}
+	now := time.Now()
+	cp := *e
+	cp.expires = now.Add(ttl)
+	c.put(key, &cp, now)
+	return nil
+}
+
+// invalidate drops the entries below prefix.
+func (c *responseCache) invalidate(ctx context.Context, prefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := range c.entries {
+		if keyUnder(k, prefix) {
+			delete(c.entries, k)
+		}
+	}
+	return nil
+}
+
+// get returns the unexpired entry for key or nil.
+func (c *responseCache) get(key string, now time.Time) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e
+}
+
+// put stores the entry for key. When the cache is full the expired entries are dropped, then the entry that expires
+// first.
+func (c *responseCache) put(key string, e *cacheEntry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.maxEntries {
+		var oldest string
+		for k, v := range c.entries {
+			if !now.Before(v.expires) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldest == "" || v.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.maxEntries {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = e
+}
+
+var (
+	// cacheOnce guards the creation of the process wide response store.
+	cacheOnce sync.Once
+	respCache responseStore
+)
+
+// getCache returns the process wide response store: the shared Redis store when cache.redis is configured and the
+// in-process cache otherwise.
+func getCache(cfg *cacheConfig) responseStore {
+	cacheOnce.Do(func() {
+		if cfg.Redis != nil {
+			respCache = newRedisStore(cfg.Redis, cfg.MaxEntryBytes)
+			return
+		}
+		respCache = newResponseCache(cfg.MaxEntries, cfg.MaxEntryBytes)
+	})
+	return respCache
+}
+
+// serveInvalidate handles DELETE /_cache/{path}, which drops the cached responses of the path and of every path
+// below it. Invalidation is disabled unless cache.allowInvalidation is set.
+func serveInvalidate(w http.ResponseWriter, r *http.Request, cfg *cacheConfig) {
+	if !cfg.AllowInvalidation {
+		http.Error(w, "cache invalidation is not enabled for this deployment", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, fmt.Sprintf("method %s is not supported for this path", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefix := "/" + strings.Trim(strings.TrimPrefix(r.URL.Path, "/"+cacheParam), "/")
+	if err := getCache(cfg).invalidate(r.Context(), prefix); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeInvalidation returns the path prefix whose cached responses are stale after a successful write, or an empty
+// string. A Firestore write changes the collection that holds the document.
+func writeInvalidation(r *http.Request, p *dataConnParam) string {
+	if p.platform != "fs" || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+		return ""
+	}
+	segs := p.connectionParams
+	if len(segs) > 1 && len(segs)%2 == 1 {
+		// The path names a document: {project}/{collection}/{document}...
+		segs = segs[:len(segs)-1]
+	}
+	return drivePath(p.platform, segs...)
+}
+
+// cachePolicy returns the cache key and TTL of the request. A zero TTL means the response is not cached. Only reads
+// of data are cached: writes, jobs, exports, callbacks and reads with the caller's credentials always reach the data
+// platform.
+func cachePolicy(r *http.Request, p *dataConnParam, cfg *cacheConfig) (string, time.Duration) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", 0
+	}
+	if p.query.Get("export") != "" || p.query.Get("callback") != "" {
+		return "", 0
+	}
+	// Responses read with the access token of a caller may not be shared with other callers.
+	if p.token != "" {
+		return "", 0
+	}
+	for _, s := range p.connectionParams {
+		if s == jobsParam {
+			return "", 0
+		}
+	}
+
+	// url.Values.Encode sorts the parameters by key so equivalent queries share an entry.
+	path := drivePath(p.platform, p.connectionParams...)
+	key := path
+	if len(p.query) > 0 {
+		key += "?" + p.query.Encode()
+	}
+	// Results masked for some callers are cached apart from the results of the others.
+	if p.mask != nil {
+		key += "#mask=" + p.mask.key
+	}
+	if len(p.filters) > 0 {
+		key += "#filter=" + rowFilterKey(p.filters)
+	}
+	return key, cfg.ttl(path)
+}
+
+// ifNoneMatch reports whether the If-None-Match header of the request matches etag. The weak comparison that
+// RFC 7232 requires for GET is used.
+func ifNoneMatch(r *http.Request, etag string) bool {
+	h := r.Header.Get("If-None-Match")
+	if h == "" {
+		return false
+	}
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
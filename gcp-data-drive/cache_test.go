@@ -0,0 +1,225 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcpdatadrive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	now := time.Now()
+	c := newResponseCache(2, 0)
+
+	put := func(key string, ttl time.Duration) {
+		e := newCacheEntry([]byte(key), nil)
+		e.expires = now.Add(ttl)
+		c.put(key, e, now)
+	}
+
+	put("a", time.Minute)
+	put("b", time.Second)
+	if c.get("a", now) == nil || c.get("b", now) == nil {
+		t.Fatalf("get() = nil Want: the cached entries")
+	}
+
+	// The cache is full so the entry that expires first is evicted.
+	put("c", time.Hour)
+	if c.get("b", now) != nil {
+		t.Errorf("get(b) = entry Want: nil after eviction")
+	}
+	if c.get("a", now) == nil || c.get("c", now) == nil {
+		t.Errorf("get() = nil Want: the remaining entries")
+	}
+
+	if c.get("a", now.Add(2*time.Minute)) != nil {
+		t.Errorf("get(a) = entry Want: nil after expiry")
+	}
+}
+
+func TestResponseCacheStore(t *testing.T) {
+	ctx := context.Background()
+	c := newResponseCache(10, 4)
+
+	for _, k := range []string{"/fs/p/events", "/fs/p/events/a?meta=body", "/fs/p/events2", "/fs/p/big"} {
+		body := []byte("1")
+		if k == "/fs/p/big" {
+			body = []byte("12345")
+		}
+		if err := c.store(ctx, k, newCacheEntry(body, nil), time.Minute); err != nil {
+			t.Fatalf("store(%q) error: %v", k, err)
+		}
+	}
+	if e, _ := c.load(ctx, "/fs/p/big"); e != nil {
+		t.Errorf("load(big) = entry Want: nil since the body exceeds the limit")
+	}
+
+	if err := c.invalidate(ctx, "/fs/p/events"); err != nil {
+		t.Fatalf("invalidate() error: %v", err)
+	}
+	for k, want := range map[string]bool{"/fs/p/events": false, "/fs/p/events/a?meta=body": false, "/fs/p/events2": true} {
+		if e, _ := c.load(ctx, k); (e != nil) != want {
+			t.Errorf("load(%q) after invalidate = %v Want: cached %v", k, e, want)
+		}
+	}
+}
+
+func TestWriteInvalidation(t *testing.T) {
+	var tests = []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"POST", "/fs/p/events", "/fs/p/events"},
+		{"PUT", "/fs/p/events/a", "/fs/p/events"},
+		{"PUT", "/fs/p/events/a/logs/b", "/fs/p/events/a/logs"},
+		{"GET", "/fs/p/events/a", ""},
+		{"POST", "/bq/p/d/v/_jobs", ""},
+	}
+
+	for _, item := range tests {
+		req := httptest.NewRequest(item.method, "https://example.com"+item.path, nil)
+		p, err := parseDDURL(req)
+		if err != nil {
+			t.Fatalf("parseDDURL(%q) error: %v", item.path, err)
+		}
+		if have := writeInvalidation(req, p); have != item.want {
+			t.Errorf("writeInvalidation(%s %s) = %q Want: %q", item.method, item.path, have, item.want)
+		}
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	var tests = []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"bq/proj/reporting/*", "/bq/proj/reporting/sales", true},
+		{"bq/proj/reporting/*", "/bq/proj/reporting/sales/_jobs", true},
+		{"bq/proj/reporting/*", "/bq/proj/reporting", false},
+		{"bq/proj/reporting", "/bq/proj/reporting/sales", true},
+		{"bq/*/reporting/sales", "/bq/other/reporting/sales", true},
+		{"fs/proj/events*", "/fs/proj/events2024", true},
+		{"fs/proj/events", "/fs/proj/eventsx", false},
+	}
+
+	for _, item := range tests {
+		if have := routeMatches(item.pattern, item.path); have != item.want {
+			t.Errorf("routeMatches(%q, %q) = %v Want: %v", item.pattern, item.path, have, item.want)
+		}
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	var tests = []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`"xyz"`, false},
+		{"*", true},
+	}
+
+	for _, item := range tests {
+		req := httptest.NewRequest("GET", "https://example.com/bq/p/d/v", nil)
+		req.Header.Set("If-None-Match", item.header)
+		if have := ifNoneMatch(req, `"abc"`); have != item.want {
+			t.Errorf("ifNoneMatch(%q) = %v Want: %v", item.header, have, item.want)
+		}
+	}
+}
+
+func TestGetJSONDataCached(t *testing.T) {
+	setConfig(&config{Cache: cacheConfig{Routes: []cacheRoute{{Route: "bq/p/d/*", TTL: duration(time.Minute)}}}})
+	defer setConfig(&config{})
+
+	e := newCacheEntry([]byte(`[{"n":1}]`), nil)
+	getCache(&cacheConfig{}).store(context.Background(), "/bq/p/d/v?types=strict", e, time.Minute)
+
+	rec := httptest.NewRecorder()
+	GetJSONData(rec, httptest.NewRequest("GET", "https://example.com/bq/p/d/v?types=strict", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != `[{"n":1}]` {
+		t.Errorf("GetJSONData() = %d %s Want: 200 with the cached body", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("ETag") != e.etag || rec.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("GetJSONData() headers = %v Want: the ETag and Cache-Control headers", rec.Header())
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/bq/p/d/v?types=strict", nil)
+	req.Header.Set("If-None-Match", e.etag)
+	rec = httptest.NewRecorder()
+	GetJSONData(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("GetJSONData() with If-None-Match = %d %s Want: 304 without a body", rec.Code, rec.Body)
+	}
+}
+
+func TestWriteResponseCacheControl(t *testing.T) {
+	e := newCacheEntry([]byte(`[]`), nil)
+	var tests = []struct {
+		p    *dataConnParam
+		ttl  time.Duration
+		want string
+	}{
+		{&dataConnParam{}, time.Minute, "public, max-age=60"},
+		{&dataConnParam{}, 0, ""},
+		{&dataConnParam{caller: "user@example.com"}, time.Minute, "private, max-age=60"},
+		{&dataConnParam{caller: "apikey:partner-a"}, 0, "private"},
+		{&dataConnParam{token: "ya29.token"}, time.Minute, "private, max-age=60"},
+		{&dataConnParam{mask: &masker{}}, time.Minute, "private, max-age=60"},
+		{&dataConnParam{filters: []boundFilter{{}}}, time.Minute, "private, max-age=60"},
+	}
+
+	for _, item := range tests {
+		rec := httptest.NewRecorder()
+		writeResponse(rec, httptest.NewRequest("GET", "/bq/p/d/v", nil), e, 0, item.ttl, item.p.personal())
+		if have := rec.Header().Get("Cache-Control"); have != item.want {
+			t.Errorf("writeResponse(%+v, %v) Cache-Control = %q Want: %q", item.p, item.ttl, have, item.want)
+		}
+		if have := rec.Header().Get("Vary"); have != "Authorization" {
+			t.Errorf("writeResponse(%+v, %v) Vary = %q Want: Authorization", item.p, item.ttl, have)
+		}
+	}
+}
+
+func TestGetJSONDataInvalidate(t *testing.T) {
+	setConfig(&config{Cache: cacheConfig{AllowInvalidation: true}})
+	defer setConfig(&config{})
+
+	ctx := context.Background()
+	getCache(&cacheConfig{}).store(ctx, "/bq/p/reporting/sales", newCacheEntry([]byte("[]"), nil), time.Minute)
+
+	rec := httptest.NewRecorder()
+	GetJSONData(rec, httptest.NewRequest("DELETE", "https://example.com/_cache/bq/p/reporting", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("GetJSONData(DELETE /_cache) = %d %s Want: 204", rec.Code, rec.Body)
+	}
+	if e, _ := getCache(&cacheConfig{}).load(ctx, "/bq/p/reporting/sales"); e != nil {
+		t.Errorf("load() after invalidation = entry Want: nil")
+	}
+
+	setConfig(&config{})
+	rec = httptest.NewRecorder()
+	GetJSONData(rec, httptest.NewRequest("DELETE", "https://example.com/_cache/bq/p/reporting", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("GetJSONData(DELETE /_cache) without allowInvalidation = %d Want: 403", rec.Code)
+	}
+}
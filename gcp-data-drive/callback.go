@@ -0,0 +1,375 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// defaultCallbackAttempts is the number of delivery attempts when callback.maxAttempts is not configured.
+	defaultCallbackAttempts = 5
+
+	// defaultCallbackTimeout bounds the background fulfillment when callback.timeout is not configured.
+	defaultCallbackTimeout = time.Hour
+
+	// webhookTimeout bounds each webhook delivery attempt.
+	webhookTimeout = 30 * time.Second
+
+	// functionTargetEnv is set by the Cloud Functions runtime.
+	functionTargetEnv = "FUNCTION_TARGET"
+)
+
+// callbackBackoff is the delay before the second delivery attempt. It doubles on each further attempt.
+var callbackBackoff = time.Second
+
+// notifier delivers the callback payload to the client.
+type notifier interface {
+	notify(ctx context.Context, requestID string, payload []byte) error
+}
+
+// permanentError marks a delivery failure that will not succeed when retried.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// callbackPayload is the notification sent once a callback request has been fulfilled.
+type callbackPayload struct {
+	RequestID string `json:"requestId"`
+
+	// Path is the gcp-data-drive path that was requested.
+	Path string `json:"path"`
+
+	// Status is DONE when the results are available and FAILED otherwise.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Result is the export response describing the location of the results.
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// callbackPlatform fulfills a request in the background and notifies the client when it is done. The request is
+// answered immediately with 202 Accepted.
+type callbackPlatform struct {
+	// inner is the data platform that fulfills the request. It is closed once the background work finishes.
+	inner dataPlatform
+
+	// notifier delivers the notification.
+	notifier notifier
+
+	// cfg holds the delivery options.
+	cfg callbackConfig
+
+	// export is the bucket that dead-letter records are written to.
+	export exportConfig
+
+	// path is the requested gcp-data-drive path.
+	path string
+}
+
+// newCallbackPlatform wraps pd when the callback query parameter is set. Webhook callbacks are https URLs and
+// Pub/Sub callbacks have the form pubsub:projects/{project}/topics/{topic}. Both must be allowed by the configuration.
+func newCallbackPlatform(pd dataPlatform, p *dataConnParam) (dataPlatform, error) {
+	target := p.query.Get("callback")
+	if target == "" {
+		return pd, nil
+	}
+
+	// Cloud Functions throttles the instance once the response is written, which would lose the background work.
+	if os.Getenv(functionTargetEnv) != "" {
+		return nil, &statusError{http.StatusNotImplemented, errors.New("callback is not supported on Cloud Functions: deploy to Cloud Run with CPU always allocated")}
+	}
+
+	cfg, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// The notification carries the location of the results, so they must be exported.
+	if p.query.Get("export") != "gcs" {
+		return nil, &statusError{http.StatusBadRequest, errors.New("callback requires export=gcs")}
+	}
+
+	n, err := newNotifier(target, &cfg.Callback)
+	if err != nil {
+		return nil, &statusError{http.StatusBadRequest, err}
+	}
+
+	return &callbackPlatform{
+		inner:    pd,
+		notifier: n,
+		cfg:      cfg.Callback,
+		export:   cfg.Export,
+		path:     drivePath(p.platform, p.connectionParams...),
+	}, nil
+}
+
+// newNotifier returns the notifier for the callback target after checking it against the allow lists. Webhooks are
+// only sent when a secret is configured to sign them.
+func newNotifier(target string, cfg *callbackConfig) (notifier, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback %q: %v", target, err)
+	}
+
+	switch u.Scheme {
+	case "https":
+		if cfg.Secret == "" {
+			return nil, errors.New("webhook callbacks require callback.secret to sign the notifications")
+		}
+		for _, h := range cfg.AllowedHosts {
+			if strings.EqualFold(h, u.Hostname()) {
+				return &webhookNotifier{url: target, secret: cfg.Secret, client: newWebhookClient()}, nil
+			}
+		}
+		return nil, fmt.Errorf("callback host %q is not allowed", u.Hostname())
+
+	case "pubsub":
+		parts := strings.Split(u.Opaque, "/")
+		if len(parts) != 4 || parts[0] != "projects" || parts[2] != "topics" {
+			return nil, fmt.Errorf("pubsub callback must be in the form pubsub:projects/{project}/topics/{topic}")
+		}
+		for _, t := range cfg.AllowedTopics {
+			if t == u.Opaque {
+				return &pubsubNotifier{projectID: parts[1], topicID: parts[3]}, nil
+			}
+		}
+		return nil, fmt.Errorf("callback topic %q is not allowed", u.Opaque)
+	}
+
+	return nil, fmt.Errorf("unsupported callback %q: https and pubsub callbacks are supported", target)
+}
+
+// getData starts the background fulfillment and returns the request id.
+func (c *callbackPlatform) getData(ctx context.Context) ([]byte, error) {
+	requestID, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.fulfill(detachedContext{ctx}, requestID)
+
+	return json.Marshal(map[string]string{"requestId": requestID})
+}
+
+// fulfill runs the inner data platform and delivers the notification. The parent context carries the values of the
+// request without its cancellation. The start and the outcome are logged so that work lost with the instance can be
+// told apart from work that is still running.
+func (c *callbackPlatform) fulfill(parent context.Context, requestID string) {
+	defer c.inner.close()
+	log.Printf("callback %s: fulfilling %s", requestID, c.path)
+
+	timeout := time.Duration(c.cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultCallbackTimeout
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	p := &callbackPayload{RequestID: requestID, Path: c.path, Status: "DONE"}
+	res, err := c.inner.getData(ctx)
+	if err != nil {
+		log.Printf("callback %s: fulfilling %s failed: %v", requestID, c.path, err)
+		p.Status = "FAILED"
+		p.Error = err.Error()
+	} else {
+		p.Result = res
+	}
+
+	payload, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("callback %s: marshaling the notification: %v", requestID, err)
+		return
+	}
+
+	if err := c.deliver(ctx, requestID, payload); err != nil {
+		log.Printf("callback %s: delivery failed: %v", requestID, err)
+		if err := c.deadLetter(ctx, requestID, payload, err); err != nil {
+			log.Printf("callback %s: writing the dead-letter record: %v", requestID, err)
+		}
+		return
+	}
+	log.Printf("callback %s: delivered the %s notification", requestID, p.Status)
+}
+
+// deliver sends the notification, retrying with exponential backoff.
+func (c *callbackPlatform) deliver(ctx context.Context, requestID string, payload []byte) error {
+	attempts := c.cfg.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultCallbackAttempts
+	}
+
+	backoff := callbackBackoff
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		if err = c.notifier.notify(ctx, requestID, payload); err == nil {
+			return nil
+		}
+		var pe *permanentError
+		if errors.As(err, &pe) {
+			return err
+		}
+	}
+	return err
+}
+
+// deadLetter records an undeliverable notification in the export bucket.
+func (c *callbackPlatform) deadLetter(ctx context.Context, requestID string, payload []byte, deliveryErr error) error {
+	rec, err := json.Marshal(map[string]interface{}{
+		"requestId":    requestID,
+		"time":         time.Now().UTC(),
+		"error":        deliveryErr.Error(),
+		"notification": json.RawMessage(payload),
+	})
+	if err != nil {
+		return err
+	}
+
+	sc, err := storage.NewClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	w := sc.Bucket(c.export.Bucket).Object(path.Join(c.export.Prefix, "dead-letter", requestID+".json")).NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(rec); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// status returns 202 Accepted since the request is fulfilled in the background.
+func (c *callbackPlatform) status() int {
+	return http.StatusAccepted
+}
+
+// close is a no-op. The inner data platform is closed by the background fulfillment.
+func (c *callbackPlatform) close() error {
+	return nil
+}
+
+// webhookNotifier POSTs the notification to an https URL. The Unix time of the delivery attempt is sent in the
+// X-Data-Drive-Timestamp header, and the timestamp and body are signed with HMAC-SHA256 using the configured secret
+// and the hex signature is sent in the X-Data-Drive-Signature header.
+type webhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// newWebhookClient returns the client of webhook deliveries. Redirects are not followed, so an allowed host can not
+// send the notification on to a host that is not allowed.
+func newWebhookClient() *http.Client {
+	return &http.Client{
+		Timeout: webhookTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// notify POSTs the payload. Redirects are answered as failures. Client errors other than 429 Too Many Requests are not retried.
+func (n *webhookNotifier) notify(ctx context.Context, requestID string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Data-Drive-Request-Id", requestID)
+	req.Header.Set("X-Data-Drive-Timestamp", ts)
+	req.Header.Set("X-Data-Drive-Signature", "sha256="+signPayload(n.secret, ts, payload))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests:
+		return &permanentError{fmt.Errorf("webhook responded %s", resp.Status)}
+	}
+	return fmt.Errorf("webhook responded %s", resp.Status)
+}
+
+// signPayload returns the hex HMAC-SHA256 of the timestamp and the payload joined by a dot. Signing the timestamp
+// lets receivers reject replayed notifications.
+func signPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pubsubNotifier publishes the notification to a Pub/Sub topic.
+type pubsubNotifier struct {
+	projectID string
+	topicID   string
+}
+
+// notify publishes the payload with the request id as a message attribute.
+func (n *pubsubNotifier) notify(ctx context.Context, requestID string, payload []byte) error {
+	client, err := pubsub.NewClient(ctx, n.projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	t := client.Topic(n.topicID)
+	defer t.Stop()
+
+	_, err = t.Publish(ctx, &pubsub.Message{
+		Data:       payload,
+		Attributes: map[string]string{"requestId": requestID},
+	}).Get(ctx)
+	return err
+}
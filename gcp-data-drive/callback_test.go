@@ -0,0 +1,145 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcpdatadrive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewNotifier(t *testing.T) {
+	cfg := &callbackConfig{
+		Secret:        "s3cret",
+		AllowedHosts:  []string{"hooks.example.com"},
+		AllowedTopics: []string{"projects/p/topics/done"},
+	}
+
+	var tests = []struct {
+		in    string
+		isErr bool
+	}{
+		{"https://hooks.example.com/notify", false},
+		{"https://HOOKS.example.com:8443/notify", false},
+		{"https://evil.example.com/notify", true},
+		{"http://hooks.example.com/notify", true},
+		{"pubsub:projects/p/topics/done", false},
+		{"pubsub:projects/p/topics/other", true},
+		{"pubsub:topics/done", true},
+	}
+
+	for _, item := range tests {
+		_, err := newNotifier(item.in, cfg)
+		if (err != nil) != item.isErr {
+			t.Errorf("newNotifier(%v) error = %v, want error %v", item.in, err, item.isErr)
+		}
+	}
+
+	// Unsigned webhooks could be forged, so they are not sent.
+	cfg.Secret = ""
+	if _, err := newNotifier("https://hooks.example.com/notify", cfg); err == nil {
+		t.Errorf("newNotifier() without a secret error = nil Want: an error")
+	}
+	if _, err := newNotifier("pubsub:projects/p/topics/done", cfg); err != nil {
+		t.Errorf("newNotifier(pubsub) without a secret error = %v Want: nil", err)
+	}
+}
+
+func TestCallbackDeliver(t *testing.T) {
+	callbackBackoff = time.Millisecond
+
+	var tests = []struct {
+		codes    []int
+		attempts int
+		isErr    bool
+	}{
+		{[]int{200}, 1, false},
+		{[]int{503, 429, 204}, 3, false},
+		{[]int{400}, 1, true},
+		{[]int{500, 500, 500}, 3, true},
+	}
+
+	for _, item := range tests {
+		var calls int
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			ts := r.Header.Get("X-Data-Drive-Timestamp")
+			if sent, err := strconv.ParseInt(ts, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+				t.Errorf("webhook timestamp = %q Want: the current Unix time", ts)
+			}
+			if want := "sha256=" + signPayload("s3cret", ts, body); r.Header.Get("X-Data-Drive-Signature") != want {
+				t.Errorf("webhook signature = %q Want: %q", r.Header.Get("X-Data-Drive-Signature"), want)
+			}
+			w.WriteHeader(item.codes[calls])
+			calls++
+		}))
+
+		u, _ := url.Parse(srv.URL)
+		n, err := newNotifier(srv.URL, &callbackConfig{Secret: "s3cret", AllowedHosts: []string{u.Hostname()}})
+		if err != nil {
+			t.Fatalf("newNotifier(%v): unexpected error %v", srv.URL, err)
+		}
+		n.(*webhookNotifier).client.Transport = srv.Client().Transport
+
+		c := &callbackPlatform{notifier: n, cfg: callbackConfig{MaxAttempts: 3}}
+		err = c.deliver(context.Background(), "id", []byte(`{"status":"DONE"}`))
+		if (err != nil) != item.isErr {
+			t.Errorf("deliver() with responses %v error = %v, want error %v", item.codes, err, item.isErr)
+		}
+		if calls != item.attempts {
+			t.Errorf("deliver() with responses %v made %d attempts Want: %d", item.codes, calls, item.attempts)
+		}
+		srv.Close()
+	}
+}
+
+func TestCallbackRedirect(t *testing.T) {
+	var redirected bool
+	internal := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer internal.Close()
+	srv := httptest.NewTLSServer(http.RedirectHandler(internal.URL, http.StatusTemporaryRedirect))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	n, err := newNotifier(srv.URL, &callbackConfig{Secret: "s3cret", AllowedHosts: []string{u.Hostname()}})
+	if err != nil {
+		t.Fatalf("newNotifier(%v): unexpected error %v", srv.URL, err)
+	}
+	n.(*webhookNotifier).client.Transport = srv.Client().Transport
+
+	// The redirect is a permanent failure and the host it names is never called.
+	var pe *permanentError
+	if err := n.notify(context.Background(), "id", []byte(`{}`)); !errors.As(err, &pe) || redirected {
+		t.Errorf("notify() with a redirect error = %v, redirected %v Want: a permanent error without the redirect", err, redirected)
+	}
+}
+
+func TestCallbackOnCloudFunctions(t *testing.T) {
+	setConfig(&config{Callback: callbackConfig{AllowedHosts: []string{"hooks.example.com"}}})
+	t.Setenv(functionTargetEnv, "GetJSONData")
+
+	p := &dataConnParam{platform: "bq", connectionParams: []string{"p", "d", "v"},
+		query: url.Values{"export": {"gcs"}, "callback": {"https://hooks.example.com/notify"}}}
+	if _, err := newCallbackPlatform(nil, p); errorStatus(err) != http.StatusNotImplemented {
+		t.Errorf("newCallbackPlatform() on Cloud Functions error = %v Want: 501 Not Implemented", err)
+	}
+}
@@ -15,16 +15,22 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/GoogleCloudPlatform/DIY-Tools/gcp-data-drive/gcpdatadrive"
 )
 
 func main() {
-	// Register the initial HTTP handler.
-	http.HandleFunc("/", gcpdatadrive.GetJSONData)
+	// Register the initial HTTP handler. A mux of our own keeps the handlers that packages register on
+	// http.DefaultServeMux, such as expvar's /debug/vars, from being served.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", gcpdatadrive.GetJSONData)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -32,8 +38,29 @@ func main() {
 		log.Printf("Defaulting to port %s", port)
 	}
 
+	// Cloud Run sends SIGTERM and allows 10 seconds before the instance is stopped. The requests in flight are
+	// finished and the batched spans exported within that time.
+	srv := &http.Server{Addr: ":" + port, Handler: mux}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+		<-stop
+
+		ctx, cancel := context.WithTimeout(context.Background(), 9*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Shutting down the server: %v", err)
+		}
+		if err := gcpdatadrive.Shutdown(ctx); err != nil {
+			log.Printf("Flushing the traces: %v", err)
+		}
+	}()
+
 	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-done
 }
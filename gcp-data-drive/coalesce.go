@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcpdatadrive
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	// coalescedRequests counts the requests that were answered by another request's call to the data platform.
+	coalescedRequests = newCounter("datadrive_coalesced_requests_total",
+		"Requests answered by the data platform call of an identical concurrent request.")
+
+	// flights deduplicates the concurrent reads of the process.
+	flights = &flightGroup{calls: map[string]*flightCall{}}
+)
+
+// flightGroup shares a single call to the data platform between concurrent identical requests. Each caller waits
+// with its own context. The shared call is only cancelled once every caller waiting on it has gone away.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is an in-flight call and its result.
+type flightCall struct {
+	// done is closed once the result is available.
+	done chan struct{}
+
+	// waiters is the number of callers still waiting on the result.
+	waiters int
+
+	// cancel cancels the context of the shared call.
+	cancel context.CancelFunc
+
+	entry *cacheEntry
+	code  int
+	err   error
+}
+
+// do calls fn for key unless a call for key is already in flight, in which case the result of that call is
+// returned. fn runs with a context that carries the values of the first caller's context but is only cancelled
+// when every caller has gone away.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) (*cacheEntry, int, error)) (*cacheEntry, int, error) {
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if ok {
+		c.waiters++
+		g.mu.Unlock()
+		coalescedRequests.Inc()
+	} else {
+		callCtx, cancel := context.WithCancel(detachedContext{ctx})
+		c = &flightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		g.calls[key] = c
+		g.mu.Unlock()
+
+		go func() {
+			c.entry, c.code, c.err = fn(callCtx)
+			g.mu.Lock()
+			g.forget(key, c)
+			g.mu.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+
+	select {
+	case <-c.done:
+		return c.entry, c.code, c.err
+
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Nobody is left to use the result.
+			g.forget(key, c)
+			c.cancel()
+		}
+		g.mu.Unlock()
+		return nil, 0, ctx.Err()
+	}
+}
+
+// forget removes c from the in-flight calls unless a newer call for key has replaced it. g.mu must be held.
+func (g *flightGroup) forget(key string, c *flightCall) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+// detachedContext carries the values of its parent without its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcpdatadrive
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFlightGroupShares(t *testing.T) {
+	g := &flightGroup{calls: map[string]*flightCall{}}
+	release := make(chan struct{})
+	var calls int32
+
+	fn := func(ctx context.Context) (*cacheEntry, int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return newCacheEntry([]byte("shared"), nil), 0, nil
+	}
+
+	before := testutil.ToFloat64(coalescedRequests)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, _, err := g.do(context.Background(), "key", fn)
+			if err != nil || string(e.body) != "shared" {
+				t.Errorf("do() = %v, %v Want: the shared entry", e, err)
+			}
+		}()
+	}
+
+	// Wait for every caller to join the call before releasing it.
+	for testutil.ToFloat64(coalescedRequests)-before < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("do() made %d calls Want: 1", calls)
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	g := &flightGroup{calls: map[string]*flightCall{}}
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	fn := func(ctx context.Context) (*cacheEntry, int, error) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return nil, 0, ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, _, err := g.do(ctx1, "key", fn)
+		errs <- err
+	}()
+	<-started
+
+	before := testutil.ToFloat64(coalescedRequests)
+	go func() {
+		_, _, err := g.do(ctx2, "key", fn)
+		errs <- err
+	}()
+	for testutil.ToFloat64(coalescedRequests) == before {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The first caller going away leaves the call running for the second.
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("do() = %v Want: %v", err, context.Canceled)
+	}
+	select {
+	case <-cancelled:
+		t.Fatalf("the shared call was cancelled while a caller was still waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancel2()
+	<-errs
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("the shared call was not cancelled after every caller went away")
+	}
+}
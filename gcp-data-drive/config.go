@@ -0,0 +1,600 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configEnv is the environment variable that names the JSON configuration file.
+const configEnv = "GCP_DATA_DRIVE_CONFIG"
+
+// config is the deployment configuration of gcp-data-drive. Every option is optional so a deployment without a
+// configuration file behaves as it always has.
+type config struct {
+	// Export configures the Cloud Storage destination of ?export=gcs requests.
+	Export exportConfig `json:"export"`
+
+	// Callback configures the notifications of ?callback= requests.
+	Callback callbackConfig `json:"callback"`
+
+	// Cache configures the response cache.
+	Cache cacheConfig `json:"cache"`
+
+	// BigQuery configures the queries run for BigQuery paths.
+	BigQuery bigQueryConfig `json:"bigquery"`
+
+	// Firestore configures the Firestore paths.
+	Firestore firestoreConfig `json:"firestore"`
+
+	// Queries is the catalog of named BigQuery queries served at /q/{name}.
+	Queries []savedQuery `json:"queries"`
+
+	// Auth configures the verification of bearer tokens.
+	Auth authConfig `json:"auth"`
+
+	// Authz configures which callers may use which paths.
+	Authz authzConfig `json:"authz"`
+
+	// Passthrough configures the use of the caller's OAuth access token for BigQuery and Firestore.
+	Passthrough passthroughConfig `json:"passthrough"`
+
+	// Impersonation selects the service accounts that the paths they match are read as. The first matching route
+	// applies.
+	Impersonation []impersonationRoute `json:"impersonation"`
+
+	// APIKeys configures the API keys of callers that can not use a Google identity.
+	APIKeys apiKeysConfig `json:"apiKeys"`
+
+	// SignedRequests configures the verification of Media CDN signed requests.
+	SignedRequests signedRequestsConfig `json:"signedRequests"`
+
+	// Masking lists the rules that redact fields from the results of the paths they match.
+	Masking []maskRule `json:"masking"`
+
+	// RowFilters restrict the rows and documents of the paths they match to those of the caller's claims.
+	RowFilters []rowFilter `json:"rowFilters"`
+
+	// Tracing configures the export of OpenTelemetry spans.
+	Tracing tracingConfig `json:"tracing"`
+
+	// Metrics configures the Prometheus metrics.
+	Metrics metricsConfig `json:"metrics"`
+}
+
+// metricsConfig configures the Prometheus metrics.
+type metricsConfig struct {
+	// Routes name the route label of the paths they match. The first matching route applies.
+	Routes []metricsRoute `json:"routes"`
+}
+
+// metricsRoute names the route label of the paths matched by Route.
+type metricsRoute struct {
+	Route string `json:"route"`
+	Name  string `json:"name"`
+}
+
+// firestoreConfig configures the Firestore paths.
+type firestoreConfig struct {
+	// AllowWrites enables PUT and POST requests that write documents. Firestore paths are read only without it.
+	AllowWrites bool `json:"allowWrites"`
+}
+
+// tracingConfig configures the OTLP/HTTP export of the spans of the requests. The standard OTEL_EXPORTER_OTLP_*
+// environment variables apply to the options that are not set here.
+type tracingConfig struct {
+	// Enabled records and exports the spans.
+	Enabled bool `json:"enabled"`
+
+	// Endpoint is the host:port of the OTLP/HTTP collector, and Insecure sends the spans over plain HTTP.
+	Endpoint string `json:"endpoint"`
+	Insecure bool   `json:"insecure"`
+
+	// Headers are added to the export requests.
+	Headers map[string]string `json:"headers"`
+
+	// SampleRatio is the fraction of the traces started by Data Drive that are sampled. It defaults to 1. Requests
+	// with a traceparent follow the sampling decision of their caller.
+	SampleRatio *float64 `json:"sampleRatio"`
+
+	// ServiceName names the service in the traces. It defaults to gcp-data-drive.
+	ServiceName string `json:"serviceName"`
+}
+
+// rowFilter restricts the results of the paths matched by Route to the rows whose Field equals the Claim of the
+// caller's bearer token. An array claim matches the rows whose field is any of its values.
+type rowFilter struct {
+	Route string `json:"route"`
+
+	// Field is the BigQuery column or Firestore document field. Nested BigQuery columns are named with dots.
+	Field string `json:"field"`
+
+	// Claim is the name of the token claim holding the value.
+	Claim string `json:"claim"`
+}
+
+// maskRule redacts the fields of the results of the paths matched by Route for the callers it applies to.
+type maskRule struct {
+	Route string `json:"route"`
+
+	// Fields lists the field names. Nested fields of records and maps are named with dots, as in address.street.
+	Fields []string `json:"fields"`
+
+	// Action is drop to remove the fields, null to clear them, hash to replace them with their HMAC-SHA256 under the
+	// secret salt or partial to mask all but their last Keep characters.
+	Action string `json:"action"`
+	Keep   int    `json:"keep"`
+
+	// Principals lists the callers the rule applies to, in the form of authz principals. The rule applies to every
+	// caller when it is empty, except to the callers listed in Except.
+	Principals []string `json:"principals"`
+	Except     []string `json:"except"`
+}
+
+// signedRequestsConfig configures the verification of requests signed with the Ed25519 keys of Media CDN keysets.
+type signedRequestsConfig struct {
+	// Keysets maps the keyset names used as KeyName to their base64url encoded Ed25519 public keys.
+	Keysets map[string][]string `json:"keysets"`
+
+	// Routes lists the path patterns that require a valid signature. Every path requires one when it is empty and
+	// keysets are configured.
+	Routes []string `json:"routes"`
+}
+
+// apiKeysConfig configures the API keys and where their usage is counted.
+type apiKeysConfig struct {
+	// Header is the request header carrying the key. It defaults to X-API-Key.
+	Header string `json:"header"`
+
+	// Keys lists the keys held in the configuration file.
+	Keys []apiKey `json:"keys"`
+
+	// Firestore is the project/collection path of a Firestore collection holding more keys. The id of each document
+	// is the hash of its key.
+	Firestore string `json:"firestore"`
+
+	// Required rejects the requests that carry neither a key nor a verified identity.
+	Required bool `json:"required"`
+
+	// Admins lists the principals, in the form of the authorization rules, that the usage of every key is reported
+	// to.
+	Admins []string `json:"admins"`
+
+	// Redis counts the usage in a Redis store shared by every instance. Without it each instance counts its own
+	// usage.
+	Redis *redisConfig `json:"redis"`
+}
+
+// apiKey is an API key with its allowed routes and quotas. Keys are only stored as hashes.
+type apiKey struct {
+	// Name identifies the key in the usage report and as the apikey:{name} caller.
+	Name string `json:"name" firestore:"name"`
+
+	// Hash is the hex encoded SHA-256 hash of the key.
+	Hash string `json:"hash" firestore:"-"`
+
+	// Routes lists the path patterns the key may use. Every path is allowed when it is empty.
+	Routes []string `json:"routes" firestore:"routes"`
+
+	// RequestsPerMinute limits the requests made with the key each minute.
+	RequestsPerMinute int64 `json:"requestsPerMinute" firestore:"requestsPerMinute"`
+
+	// DailyRows and DailyBytes limit the rows and bytes returned to the key each UTC day.
+	DailyRows  int64 `json:"dailyRows" firestore:"dailyRows"`
+	DailyBytes int64 `json:"dailyBytes" firestore:"dailyBytes"`
+}
+
+// impersonationRoute reads the paths matched by Route as ServiceAccount.
+type impersonationRoute struct {
+	Route string `json:"route"`
+
+	// ServiceAccount is the email of the impersonated service account. The service account of the deployment needs
+	// the Service Account Token Creator role on it.
+	ServiceAccount string `json:"serviceAccount"`
+
+	// Delegates lists the service accounts of a delegation chain, if any.
+	Delegates []string `json:"delegates"`
+}
+
+// passthroughConfig configures end-user credential passthrough, so that BigQuery and Firestore IAM apply to the
+// caller instead of the service account.
+type passthroughConfig struct {
+	// Enabled builds the BigQuery and Firestore clients of a request with the access token of the caller.
+	Enabled bool `json:"enabled"`
+
+	// Header is the request header carrying the access token. It defaults to the bearer token of the Authorization
+	// header; set it when Authorization carries an ID token verified by auth.
+	Header string `json:"header"`
+
+	// Required rejects requests without an access token. Otherwise they run as the service account.
+	Required bool `json:"required"`
+}
+
+// authConfig configures the bearer tokens accepted by gcp-data-drive. Requests are not authenticated when no issuer
+// is configured.
+type authConfig struct {
+	// Issuers lists the trusted token issuers.
+	Issuers []issuerConfig `json:"issuers"`
+
+	// AllowAnonymous lets requests without an Authorization header through. Tokens that are sent are still verified.
+	AllowAnonymous bool `json:"allowAnonymous"`
+
+	// IAP trusts the callers authenticated by Identity-Aware Proxy in front of the service. The signed header of
+	// the proxy is verified and required on every request, and bearer tokens are not checked.
+	IAP *iapConfig `json:"iap"`
+}
+
+// iapConfig configures the verification of the headers signed by Identity-Aware Proxy.
+type iapConfig struct {
+	// Audience is the aud claim of the signed headers: /projects/{number}/global/backendServices/{id} behind a
+	// load balancer, or /projects/{number}/apps/{project} on App Engine.
+	Audience string `json:"audience"`
+}
+
+// issuerConfig configures a trusted OpenID Connect issuer.
+type issuerConfig struct {
+	// Issuer is the iss claim of the tokens, such as https://accounts.google.com for Google-signed ID tokens.
+	Issuer string `json:"issuer"`
+
+	// JWKSURL serves the signing keys of the issuer. It defaults to the Google certificates for Google and to the
+	// jwks_uri of the OpenID configuration of the issuer otherwise.
+	JWKSURL string `json:"jwksUrl"`
+
+	// Audiences lists the accepted aud claims. At least one is required.
+	Audiences []string `json:"audiences"`
+}
+
+// exportConfig configures the Cloud Storage bucket that large results are exported to.
+type exportConfig struct {
+	// Bucket is the name of the bucket the results are written to. Exports are disabled when it is empty.
+	Bucket string `json:"bucket"`
+
+	// Prefix is prepended to the name of every exported object.
+	Prefix string `json:"prefix"`
+
+	// SignedURLTTL is how long the signed download URLs stay valid. Signed URLs are only returned when it is set.
+	SignedURLTTL duration `json:"signedUrlTtl"`
+}
+
+// callbackConfig configures the delivery of callback notifications.
+type callbackConfig struct {
+	// Secret is the HMAC-SHA256 key used to sign webhook notifications.
+	Secret string `json:"secret"`
+
+	// AllowedHosts lists the host names that webhook notifications may be sent to.
+	AllowedHosts []string `json:"allowedHosts"`
+
+	// AllowedTopics lists the Pub/Sub topics, as projects/{project}/topics/{topic}, that notifications may be
+	// published to.
+	AllowedTopics []string `json:"allowedTopics"`
+
+	// MaxAttempts is the number of delivery attempts before a dead-letter record is written.
+	MaxAttempts int `json:"maxAttempts"`
+
+	// Timeout bounds the time spent fulfilling the request and delivering the notification.
+	Timeout duration `json:"timeout"`
+}
+
+// cacheConfig configures how long responses are cached. Responses are not cached unless a TTL applies.
+type cacheConfig struct {
+	// DefaultTTL applies to the paths that do not match a route.
+	DefaultTTL duration `json:"defaultTtl"`
+
+	// MaxEntries limits the number of responses held in memory.
+	MaxEntries int `json:"maxEntries"`
+
+	// MaxEntryBytes limits the size of a cached response so that large payloads are not cached. Zero means no
+	// limit. With Redis the limit applies to the compressed value.
+	MaxEntryBytes int `json:"maxEntryBytes"`
+
+	// Redis selects a Redis store, such as Memorystore, that is shared by every instance instead of the in-process
+	// cache.
+	Redis *redisConfig `json:"redis"`
+
+	// AllowInvalidation enables DELETE /_cache/{path} requests.
+	AllowInvalidation bool `json:"allowInvalidation"`
+
+	// Routes set the TTL of the paths they match. The first matching route applies.
+	Routes []cacheRoute `json:"routes"`
+}
+
+// redisConfig configures the Redis response store.
+type redisConfig struct {
+	// Addr is the host:port of the Redis server.
+	Addr     string `json:"addr"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+
+	// KeyPrefix namespaces the keys of the deployment. It defaults to "gcpdatadrive:".
+	KeyPrefix string `json:"keyPrefix"`
+
+	// CompressAbove is the size in bytes above which entries are gzip compressed. It defaults to 1024 and a
+	// negative value disables compression.
+	CompressAbove int `json:"compressAbove"`
+}
+
+// cacheRoute sets the TTL of the paths matched by Route.
+type cacheRoute struct {
+	Route string   `json:"route"`
+	TTL   duration `json:"ttl"`
+}
+
+// ttl returns how long the response for path may be cached.
+func (c *cacheConfig) ttl(path string) time.Duration {
+	for _, r := range c.Routes {
+		if routeMatches(r.Route, path) {
+			return time.Duration(r.TTL)
+		}
+	}
+	return time.Duration(c.DefaultTTL)
+}
+
+// bigQueryConfig configures the BigQuery queries. The options apply to every query and the first route matching the
+// path overrides the options it sets.
+type bigQueryConfig struct {
+	bqOptions
+
+	Routes []bqRoute `json:"routes"`
+
+	// Functions lists the routes of the table-valued functions that are called with the url query parameters as
+	// their arguments.
+	Functions []string `json:"functions"`
+}
+
+// function reports whether the path names a configured table-valued function.
+func (c *bigQueryConfig) function(path string) bool {
+	for _, f := range c.Functions {
+		if routeMatches(f, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// bqRoute sets the query options of the paths matched by Route.
+type bqRoute struct {
+	Route string `json:"route"`
+
+	// Name identifies the route in the labels of the jobs it runs.
+	Name string `json:"name"`
+
+	bqOptions
+}
+
+// bqOptions are the options of a BigQuery query.
+type bqOptions struct {
+	// MaxBytesBilled fails queries that would bill more bytes. Zero means no limit.
+	MaxBytesBilled int64 `json:"maxBytesBilled"`
+
+	// DryRun estimates the bytes processed before running the query and rejects queries over MaxBytesBilled
+	// without running them.
+	DryRun *bool `json:"dryRun"`
+
+	// BillingProject is the project that runs and pays for the jobs. It defaults to the project in the path.
+	BillingProject string `json:"billingProject"`
+
+	// Location is the location the jobs run in, such as US or europe-west1.
+	Location string `json:"location"`
+
+	// Labels are added to every job. Route labels are merged over the global labels.
+	Labels map[string]string `json:"labels"`
+
+	// Priority is interactive or batch.
+	Priority string `json:"priority"`
+
+	// DisableQueryCache stops the results from being served from the BigQuery query cache.
+	DisableQueryCache *bool `json:"disableQueryCache"`
+
+	// JobTimeout cancels the jobs that run longer.
+	JobTimeout duration `json:"jobTimeout"`
+}
+
+// options returns the query options for path and the name of the route that matched it.
+func (c *bigQueryConfig) options(path string) (bqOptions, string) {
+	o := c.bqOptions
+	for _, r := range c.Routes {
+		if !routeMatches(r.Route, path) {
+			continue
+		}
+		if r.MaxBytesBilled != 0 {
+			o.MaxBytesBilled = r.MaxBytesBilled
+		}
+		if r.DryRun != nil {
+			o.DryRun = r.DryRun
+		}
+		if r.BillingProject != "" {
+			o.BillingProject = r.BillingProject
+		}
+		if r.Location != "" {
+			o.Location = r.Location
+		}
+		if len(r.Labels) > 0 {
+			labels := map[string]string{}
+			for k, v := range o.Labels {
+				labels[k] = v
+			}
+			for k, v := range r.Labels {
+				labels[k] = v
+			}
+			o.Labels = labels
+		}
+		if r.Priority != "" {
+			o.Priority = r.Priority
+		}
+		if r.DisableQueryCache != nil {
+			o.DisableQueryCache = r.DisableQueryCache
+		}
+		if r.JobTimeout != 0 {
+			o.JobTimeout = r.JobTimeout
+		}
+		return o, r.Name
+	}
+	return o, ""
+}
+
+// authzConfig configures the authorization of requests. Requests are allowed when there are no rules and deny by
+// default is off.
+type authzConfig struct {
+	// Rules are evaluated in order and the first rule matching the request decides.
+	Rules []authzRule `json:"rules"`
+
+	// DenyByDefault denies the requests that match no rule. Otherwise they are allowed.
+	DenyByDefault bool `json:"denyByDefault"`
+
+	// DryRun logs every decision without enforcing it.
+	DryRun bool `json:"dryRun"`
+}
+
+// authzRule allows or denies the callers matching Principals the methods of the paths matched by Route.
+type authzRule struct {
+	Route string `json:"route"`
+
+	// Methods lists the HTTP methods of the rule. "read" stands for GET and HEAD and "write" for POST, PUT and
+	// DELETE. Every method matches when it is empty.
+	Methods []string `json:"methods"`
+
+	// Principals are caller emails, which may use wildcards such as *@etl.iam.gserviceaccount.com, group:{email}
+	// for the members of a group named in the groups claim of the token, allAuthenticatedUsers and allUsers.
+	Principals []string `json:"principals"`
+
+	// Effect is allow or deny. It defaults to allow.
+	Effect string `json:"effect"`
+}
+
+// savedQuery is a named BigQuery query run with the parameters of the request URL.
+type savedQuery struct {
+	Name string `json:"name"`
+
+	// Project is the project the query runs in when bigquery.billingProject is not set.
+	Project string `json:"project"`
+
+	// SQL is the standard SQL query. Parameters are referenced as @name.
+	SQL string `json:"sql"`
+
+	Params []queryParam `json:"params"`
+}
+
+// queryParam declares a query parameter read from the URL query parameter of the same name.
+type queryParam struct {
+	Name string `json:"name"`
+
+	// Type is one of STRING, INT64, FLOAT64, NUMERIC, BIGNUMERIC, BOOL, DATE, DATETIME and TIMESTAMP. It defaults
+	// to STRING.
+	Type string `json:"type"`
+
+	// Default is used when the request does not set the parameter. Parameters without a default are required.
+	Default *string `json:"default"`
+
+	// Values restricts the parameter to the listed values.
+	Values []string `json:"values"`
+
+	// Pattern is a regular expression that the whole value must match.
+	Pattern string `json:"pattern"`
+
+	// Min and Max bound the numeric parameters.
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+// query returns the saved query called name.
+func (c *config) query(name string) (*savedQuery, bool) {
+	for i := range c.Queries {
+		if c.Queries[i].Name == name {
+			return &c.Queries[i], true
+		}
+	}
+	return nil, false
+}
+
+// routeMatches reports whether the route pattern matches the gcp-data-drive path. Each segment of the pattern is
+// matched against the corresponding path segment with path.Match, so "*" matches a whole segment, and the path may
+// continue below the pattern. For example bq/proj/reporting/* matches every view in the reporting dataset and
+// everything below them.
+func routeMatches(pattern, p string) bool {
+	ps := strings.Split(strings.Trim(pattern, "/"), "/")
+	segs := strings.Split(strings.Trim(p, "/"), "/")
+	if len(segs) < len(ps) {
+		return false
+	}
+	for i, s := range ps {
+		if ok, err := path.Match(s, segs[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// duration is a time.Duration that is written in configuration files as a string such as "15m".
+type duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+var (
+	// configOnce guards the loading of the configuration file.
+	configOnce sync.Once
+
+	// loadedConfig and loadedConfigErr hold the result of loading the configuration file.
+	loadedConfig    *config
+	loadedConfigErr error
+)
+
+// getConfig returns the configuration, loading it on first use.
+func getConfig() (*config, error) {
+	configOnce.Do(func() {
+		loadedConfig, loadedConfigErr = loadConfig(os.Getenv(configEnv))
+	})
+	return loadedConfig, loadedConfigErr
+}
+
+// setConfig replaces the configuration. It is used by tests.
+func setConfig(c *config) {
+	configOnce.Do(func() {})
+	loadedConfig, loadedConfigErr = c, nil
+}
+
+// loadConfig reads the configuration file. An empty path returns the default configuration.
+func loadConfig(path string) (*config, error) {
+	c := &config{}
+	if path == "" {
+		return c, nil
+	}
+
+	bts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", configEnv, err)
+	}
+	if err := json.Unmarshal(bts, c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", configEnv, err)
+	}
+	return c, nil
+}
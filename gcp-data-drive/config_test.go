@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcpdatadrive
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(`{"export": {"bucket": "b", "signedUrlTtl": "15m"}}`), 0600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+
+	c, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig(%v): unexpected error %v", path, err)
+	}
+	if c.Export.Bucket != "b" || time.Duration(c.Export.SignedURLTTL) != 15*time.Minute {
+		t.Errorf("loadConfig(%v) = %+v Want: bucket b with a 15m signed URL ttl", path, c.Export)
+	}
+
+	if c, err := loadConfig(""); err != nil || c.Export.Bucket != "" {
+		t.Errorf("loadConfig(\"\") = %+v, %v Want: the default configuration", c, err)
+	}
+
+	if _, err := loadConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("loadConfig(missing.json): An error was expected but no error was returned")
+	}
+}
+
+func TestBigQueryOptions(t *testing.T) {
+	var c config
+	if err := json.Unmarshal([]byte(`{"bigquery": {
+		"maxBytesBilled": 1000,
+		"routes": [
+			{"route": "bq/p/big/*", "maxBytesBilled": 10, "dryRun": true},
+			{"route": "bq/p/*", "dryRun": false}
+		]}}`), &c); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+
+	var tests = []struct {
+		path     string
+		maxBytes int64
+		dryRun   *bool
+	}{
+		{"/bq/p/big/v", 10, boolPtr(true)},
+		{"/bq/p/small/v", 1000, boolPtr(false)},
+		{"/bq/other/d/v", 1000, nil},
+	}
+
+	for _, item := range tests {
+		have, _ := c.BigQuery.options(item.path)
+		if have.MaxBytesBilled != item.maxBytes || !reflect.DeepEqual(have.DryRun, item.dryRun) {
+			t.Errorf("options(%q) = %+v Want: maxBytesBilled %d dryRun %v", item.path, have, item.maxBytes, item.dryRun)
+		}
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
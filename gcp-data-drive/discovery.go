@@ -0,0 +1,186 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// listCollectionsParam is the reserved path segment that requests the subcollections of a Firestore document.
+const listCollectionsParam = "_collections"
+
+// driveItem describes a single navigable entry returned by a discovery request.
+type driveItem struct {
+	// ID is the dataset, table or collection id.
+	ID string `json:"id"`
+
+	// Type is the kind of item. Tables report the BigQuery table type (TABLE, VIEW, ...).
+	Type string `json:"type"`
+
+	// NumRows is the row count reported by BigQuery. It is only populated for tables.
+	NumRows *uint64 `json:"numRows,omitempty"`
+
+	// Path is the gcp-data-drive url path that can be used to navigate to the item.
+	Path string `json:"path"`
+}
+
+// drivePath joins the platform and item path segments into a gcp-data-drive url path.
+func drivePath(platform string, segments ...string) string {
+	return "/" + platform + "/" + strings.Join(segments, "/")
+}
+
+// bqDatasetList lists the datasets in a BigQuery project.
+type bqDatasetList struct {
+	// client is a pointer to a BQ client.
+	client *bigquery.Client
+
+	// projectID is the project that owns the datasets.
+	projectID string
+}
+
+// getData returns the datasets of the project marshaled as JSON.
+func (b *bqDatasetList) getData(ctx context.Context) ([]byte, error) {
+	res := []driveItem{}
+
+	it := b.client.DatasetsInProject(ctx, b.projectID)
+	for {
+		ds, err := it.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+		res = append(res, driveItem{
+			ID:   ds.DatasetID,
+			Type: "DATASET",
+			Path: drivePath("bq", ds.ProjectID, ds.DatasetID),
+		})
+	}
+
+	return json.Marshal(res)
+}
+
+// close will close the client connection to BigQuery.
+func (b *bqDatasetList) close() error {
+	return b.client.Close()
+}
+
+// bqTableList lists the tables and views in a BigQuery dataset.
+type bqTableList struct {
+	// client is a pointer to a BQ client.
+	client *bigquery.Client
+
+	// dataset is the dataset being listed.
+	dataset *bigquery.Dataset
+}
+
+// getData returns the tables of the dataset, with their type and row count, marshaled as JSON.
+func (b *bqTableList) getData(ctx context.Context) ([]byte, error) {
+	res := []driveItem{}
+
+	it := b.dataset.Tables(ctx)
+	for {
+		t, err := it.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+
+		// The table listing does not carry the row count so the metadata is fetched for each table.
+		md, err := t.Metadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		item := driveItem{
+			ID:   t.TableID,
+			Type: string(md.Type),
+			Path: drivePath("bq", t.ProjectID, t.DatasetID, t.TableID),
+		}
+
+		// Views do not store rows so a row count is only reported for tables.
+		if md.Type == bigquery.RegularTable {
+			n := md.NumRows
+			item.NumRows = &n
+		}
+		res = append(res, item)
+	}
+
+	return json.Marshal(res)
+}
+
+// close will close the client connection to BigQuery.
+func (b *bqTableList) close() error {
+	return b.client.Close()
+}
+
+// fsCollectionList lists the top level collections of a Firestore database or the subcollections of a document.
+type fsCollectionList struct {
+	// client is a pointer to the firestore client.
+	client *firestore.Client
+
+	// projectID is the project that owns the Firestore database.
+	projectID string
+
+	// docPath is the path of the parent document. It is empty when listing the top level collections.
+	docPath string
+}
+
+// getData returns the collections marshaled as JSON.
+func (f *fsCollectionList) getData(ctx context.Context) ([]byte, error) {
+	var it *firestore.CollectionIterator
+	if f.docPath == "" {
+		it = f.client.Collections(ctx)
+	} else {
+		it = f.client.Doc(f.docPath).Collections(ctx)
+	}
+
+	res := []driveItem{}
+	for {
+		col, err := it.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+
+		segments := []string{f.projectID}
+		if f.docPath != "" {
+			segments = append(segments, f.docPath)
+		}
+		res = append(res, driveItem{
+			ID:   col.ID,
+			Type: "COLLECTION",
+			Path: drivePath("fs", append(segments, col.ID)...),
+		})
+	}
+
+	return json.Marshal(res)
+}
+
+// close will close the firestore client connection.
+func (f *fsCollectionList) close() error {
+	return f.client.Close()
+}
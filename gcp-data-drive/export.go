@@ -0,0 +1,220 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// exportFormats maps the accepted format query parameter values to the BigQuery extract format and the
+// file extension of the exported objects.
+var exportFormats = map[string]struct {
+	bq  bigquery.DataFormat
+	ext string
+}{
+	"json":    {bigquery.JSON, "json"},
+	"csv":     {bigquery.CSV, "csv"},
+	"parquet": {bigquery.Parquet, "parquet"},
+}
+
+// exportTarget describes where and how a result set is exported to Cloud Storage instead of being streamed through
+// the web server.
+type exportTarget struct {
+	// cfg is the configured export bucket.
+	cfg exportConfig
+
+	// format is the export file format: json (newline delimited), csv or parquet.
+	format string
+}
+
+// exportObject describes a single exported object in the export response.
+type exportObject struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+
+	// SignedURL is a time limited download link. It is only set when signed URLs are configured.
+	SignedURL string     `json:"signedUrl,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+}
+
+// exportResponse is the response body of an export request.
+type exportResponse struct {
+	Format  string          `json:"format"`
+	Objects []*exportObject `json:"objects"`
+}
+
+// newExportTarget returns the export target requested with export=gcs and the format parameter. A nil target is
+// returned when no export was requested.
+func newExportTarget(q url.Values, formats ...string) (*exportTarget, error) {
+	switch q.Get("export") {
+	case "":
+		return nil, nil
+	case "gcs":
+	default:
+		return nil, &statusError{http.StatusBadRequest, fmt.Errorf(`unknown export %q: "gcs" is supported`, q.Get("export"))}
+	}
+
+	cfg, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Export.Bucket == "" {
+		return nil, &statusError{http.StatusNotImplemented, errors.New("exports are not configured for this deployment")}
+	}
+
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	for _, f := range formats {
+		if f == format {
+			return &exportTarget{cfg: cfg.Export, format: format}, nil
+		}
+	}
+	return nil, &statusError{http.StatusBadRequest, fmt.Errorf("unsupported export format %q: %v are supported", format, formats)}
+}
+
+// exportBQ extracts the result table of a finished query job into the export bucket.
+func (e *exportTarget) exportBQ(ctx context.Context, job *bigquery.Job) ([]byte, error) {
+	// The results of a query are written to a temporary table that can be extracted.
+	cfg, err := job.Config()
+	if err != nil {
+		return nil, err
+	}
+	qc, ok := cfg.(*bigquery.QueryConfig)
+	if !ok || qc.Dst == nil {
+		return nil, fmt.Errorf("job %s has no destination table to export", job.ID())
+	}
+
+	prefix := path.Join(e.cfg.Prefix, job.ID())
+	f := exportFormats[e.format]
+	gcs := bigquery.NewGCSReference(fmt.Sprintf("gs://%s/%s/data-*.%s", e.cfg.Bucket, prefix, f.ext))
+	gcs.DestinationFormat = f.bq
+
+	ext, err := qc.Dst.ExtractorTo(gcs).Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := waitJob(ctx, ext); err != nil {
+		return nil, err
+	}
+
+	sc, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+
+	return e.respond(ctx, sc, prefix)
+}
+
+// exportStream writes newline delimited JSON produced by write to a single object in the export bucket.
+func (e *exportTarget) exportStream(ctx context.Context, write func(w io.Writer) error) ([]byte, error) {
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	prefix := path.Join(e.cfg.Prefix, id)
+
+	sc, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+
+	w := sc.Bucket(e.cfg.Bucket).Object(prefix + "/data-000000000000.json").NewWriter(ctx)
+	w.ContentType = "application/x-ndjson"
+	if err := write(w); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return e.respond(ctx, sc, prefix)
+}
+
+// respond lists the exported objects below prefix and builds the response body with their URLs.
+func (e *exportTarget) respond(ctx context.Context, sc *storage.Client, prefix string) ([]byte, error) {
+	bkt := sc.Bucket(e.cfg.Bucket)
+	res := &exportResponse{Format: e.format, Objects: []*exportObject{}}
+
+	it := bkt.Objects(ctx, &storage.Query{Prefix: prefix + "/"})
+	for {
+		attrs, err := it.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+
+		obj := &exportObject{
+			Name: attrs.Name,
+			URL:  fmt.Sprintf("gs://%s/%s", attrs.Bucket, attrs.Name),
+			Size: attrs.Size,
+		}
+
+		if ttl := time.Duration(e.cfg.SignedURLTTL); ttl > 0 {
+			expires := time.Now().Add(ttl).UTC()
+			obj.Expires = &expires
+			obj.SignedURL, err = bkt.SignedURL(attrs.Name, &storage.SignedURLOptions{
+				Method:  http.MethodGet,
+				Expires: expires,
+				Scheme:  storage.SigningSchemeV4,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		res.Objects = append(res.Objects, obj)
+	}
+
+	return json.Marshal(res)
+}
+
+// randomID returns a random 128 bit hex identifier.
+func randomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// waitJob waits for a BigQuery job to finish and returns its error.
+func waitJob(ctx context.Context, job *bigquery.Job) error {
+	st, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return st.Err()
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcpdatadrive
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNewExportTarget(t *testing.T) {
+	var tests = []struct {
+		in     string
+		bucket string
+		format string
+		isErr  bool
+	}{
+		{"", "b", "", false},
+		{"export=gcs", "b", "json", false},
+		{"export=gcs&format=parquet", "b", "parquet", false},
+		{"export=gcs&format=avro", "b", "", true},
+		{"export=s3", "b", "", true},
+		{"export=gcs", "", "", true},
+	}
+
+	for _, item := range tests {
+		setConfig(&config{Export: exportConfig{Bucket: item.bucket}})
+
+		q, _ := url.ParseQuery(item.in)
+		e, err := newExportTarget(q, "json", "csv", "parquet")
+		if item.isErr {
+			if err == nil {
+				t.Errorf("newExportTarget(%v): An error was expected but no error was returned", item.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newExportTarget(%v): unexpected error %v", item.in, err)
+			continue
+		}
+
+		var format string
+		if e != nil {
+			format = e.format
+		}
+		if format != item.format {
+			t.Errorf("newExportTarget(%v) format = %q Want: %q", item.in, format, item.format)
+		}
+	}
+	setConfig(&config{})
+}
@@ -15,12 +15,26 @@
 package gcpdatadrive
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/firestore"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+	"google.golang.org/genproto/googleapis/type/latlng"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // fsDataPlatform contains the necessary information to connect and get data from Firestore platfrom.
@@ -34,36 +48,157 @@ type fsDataPlatform struct {
 
 	// isDoc indicates if the item path prepresents a firestore document or collection
 	isDoc bool
+
+	// encoder converts document values into JSON friendly values. When nil the documents are marshaled with encoding/json.
+	encoder *fsEncoder
+
+	// merge indicates that a PUT merges the fields of the body into the document instead of replacing it.
+	merge bool
+
+	// docIDKey is the name of the field the document id is added to in collection results.
+	docIDKey string
+
+	// meta is where the document metadata is placed: "" to omit it, "body" for a reserved
+	// __meta__ object in each document or "headers" for the response headers of a single document read.
+	meta string
+
+	// header holds the response headers reported by the last read.
+	header http.Header
+
+	// export is the Cloud Storage destination of a collection. When nil the documents are returned in the response.
+	export *exportTarget
+
+	// mask redacts the fields hidden from the caller before the documents are encoded.
+	mask *masker
+
+	// filters restrict the documents read and written to those matching the claims of the caller.
+	filters []boundFilter
+
+	// allowWrites enables PUT and POST requests.
+	allowWrites bool
+}
+
+// fsMeta is the document metadata placed in the reserved __meta__ object.
+type fsMeta struct {
+	// Path is the full resource name of the document.
+	Path string `json:"path"`
+
+	CreateTime string `json:"createTime"`
+	UpdateTime string `json:"updateTime"`
+	ReadTime   string `json:"readTime"`
+}
+
+// fsMetaKey is the reserved field name of the document metadata object.
+const fsMetaKey = "__meta__"
+
+// newFSMeta returns the metadata of the document snapshot with RFC 3339 timestamps.
+func newFSMeta(doc *firestore.DocumentSnapshot) *fsMeta {
+	return &fsMeta{
+		Path:       doc.Ref.Path,
+		CreateTime: doc.CreateTime.UTC().Format(time.RFC3339Nano),
+		UpdateTime: doc.UpdateTime.UTC().Format(time.RFC3339Nano),
+		ReadTime:   doc.ReadTime.UTC().Format(time.RFC3339Nano),
+	}
 }
 
 // getData is the implementation specific to firestore for extracting a document of collection of documents.
 func (f *fsDataPlatform) getData(ctx context.Context) ([]byte, error) {
 	// If the path is to a document, fulfill the request with the document.
 	if f.isDoc {
-		doc, err := f.client.Doc(f.itemPath).Get(ctx)
+		rctx, span := startSpan(ctx, "firestore get document", attribute.String("firestore.path", f.itemPath))
+		doc, err := f.client.Doc(f.itemPath).Get(rctx)
+		endSpan(span, err)
+		if err != nil {
+			return nil, err
+		}
+		observeFSReads(ctx, 1)
+
+		// Documents outside the filters of the caller are reported as missing.
+		if !filtersAllow(f.filters, doc.Data()) {
+			return nil, &statusError{http.StatusNotFound, fmt.Errorf("document %s not found", f.itemPath)}
+		}
+		_, span = startSpan(ctx, "firestore encode")
+		docItem := f.mask.maskDoc("", doc.Data())
+		if f.encoder != nil {
+			docItem, err = f.encoder.encodeDoc(docItem)
+		}
+		endSpan(span, err)
 		if err != nil {
 			return nil, err
 		}
-		docItem := doc.Data()
+
+		switch f.meta {
+		case "body":
+			docItem[fsMetaKey] = newFSMeta(doc)
+		case "headers":
+			m := newFSMeta(doc)
+			f.header = http.Header{}
+			f.header.Set("X-Document-Path", m.Path)
+			f.header.Set("X-Document-Create-Time", m.CreateTime)
+			f.header.Set("X-Document-Update-Time", m.UpdateTime)
+			f.header.Set("X-Document-Read-Time", m.ReadTime)
+		}
 		return json.Marshal(&docItem)
 	}
 
-	// Otherwise the request is for a collection.
-	q := f.client.Collection(f.itemPath)
+	// Otherwise the request is for a collection, restricted to the documents matching the filters of the caller.
+	q, err := filterFSQuery(f.client.Collection(f.itemPath).Query, f.filters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Large collections can be streamed to Cloud Storage instead of being held in memory.
+	if f.export != nil {
+		return f.export.exportStream(ctx, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			it := q.Documents(ctx)
+			defer it.Stop()
+			for {
+				doc, err := it.Next()
+				if err != nil {
+					if err == iterator.Done {
+						return nil
+					}
+					return err
+				}
+				observeFSReads(ctx, 1)
+				d, err := f.docValue(doc)
+				if err != nil {
+					return err
+				}
+				if err := enc.Encode(d); err != nil {
+					return err
+				}
+			}
+		})
+	}
 
 	// Get all the documents in a single read. Only a single read is charged.
-	docs, err := q.Documents(ctx).GetAll()
+	rctx, span := startSpan(ctx, "firestore query", attribute.String("firestore.path", f.itemPath))
+	docs, err := q.Documents(rctx).GetAll()
+	span.SetAttributes(attribute.Int("firestore.documents", len(docs)))
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
+	observeFSReads(ctx, len(docs))
+
+	_, span = startSpan(ctx, "firestore encode")
+	bts, err := f.encodeDocs(docs)
+	endSpan(span, err)
+	return bts, err
+}
 
+// encodeDocs marshals the documents of a collection result.
+func (f *fsDataPlatform) encodeDocs(docs []*firestore.DocumentSnapshot) ([]byte, error) {
 	// Create a slice of maps to hold the firestore result set.
 	res := []map[string]interface{}{}
 
 	for _, doc := range docs {
-		// Adding the doc id to the result for ease of use.
-		d := doc.Data()
-		d["docid"] = doc.Ref.ID
+		d, err := f.docValue(doc)
+		if err != nil {
+			return nil, err
+		}
 
 		// Append the doc to the map so it can be marshaled.
 		res = append(res, d)
@@ -72,6 +207,96 @@ func (f *fsDataPlatform) getData(ctx context.Context) ([]byte, error) {
 	return json.Marshal(res)
 }
 
+// docValue returns the encoded data of a document in a collection result with its id and optional metadata.
+func (f *fsDataPlatform) docValue(doc *firestore.DocumentSnapshot) (map[string]interface{}, error) {
+	d := f.mask.maskDoc("", doc.Data())
+	if f.encoder != nil {
+		var err error
+		if d, err = f.encoder.encodeDoc(d); err != nil {
+			return nil, err
+		}
+	}
+
+	// Adding the doc id to the result for ease of use.
+	d[f.docIDKey] = doc.Ref.ID
+	if f.meta == "body" {
+		d[fsMetaKey] = newFSMeta(doc)
+	}
+	return d, nil
+}
+
+// putData writes the JSON object in the body to Firestore. A PUT to a document path creates or replaces the
+// document and a POST to a collection path adds a document with a generated id.
+func (f *fsDataPlatform) putData(ctx context.Context, method string, body []byte) ([]byte, error) {
+	if !f.allowWrites {
+		return nil, &statusError{http.StatusMethodNotAllowed, errors.New("firestore writes are disabled: set firestore.allowWrites in the config to enable them")}
+	}
+
+	// Write bodies are decoded in plain mode unless a types parameter was given.
+	dec := f.encoder
+	if dec == nil {
+		dec = &fsEncoder{}
+	}
+	data, err := dec.decodeDoc(f.client, body)
+	if err != nil {
+		return nil, &statusError{http.StatusBadRequest, err}
+	}
+
+	// Written documents must match the filters of the caller.
+	if err := filterFSWrite(f.filters, data); err != nil {
+		return nil, err
+	}
+
+	var ref *firestore.DocumentRef
+	switch {
+	case f.isDoc && method == http.MethodPut && len(f.filters) > 0:
+		// The existing document is read in the same transaction so documents outside the filters are not replaced.
+		ref = f.client.Doc(f.itemPath)
+		err := f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			doc, err := tx.Get(ref)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if err == nil && !filtersAllow(f.filters, doc.Data()) {
+				return &statusError{http.StatusNotFound, fmt.Errorf("document %s not found", f.itemPath)}
+			}
+			return tx.Set(ref, data, f.setOptions()...)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+	case f.isDoc && method == http.MethodPut:
+		ref = f.client.Doc(f.itemPath)
+		if _, err := ref.Set(ctx, data, f.setOptions()...); err != nil {
+			return nil, err
+		}
+
+	case !f.isDoc && method == http.MethodPost:
+		if ref, _, err = f.client.Collection(f.itemPath).Add(ctx, data); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, &statusError{http.StatusMethodNotAllowed, errors.New("use PUT to write a document and POST to add a document to a collection")}
+	}
+
+	return json.Marshal(map[string]string{f.docIDKey: ref.ID})
+}
+
+// setOptions returns the options of a PUT, which merges the body into the document when merge=true.
+func (f *fsDataPlatform) setOptions() []firestore.SetOption {
+	if f.merge {
+		return []firestore.SetOption{firestore.MergeAll}
+	}
+	return nil
+}
+
+// headers returns the response headers reported by the last read.
+func (f *fsDataPlatform) headers() http.Header {
+	return f.header
+}
+
 // close will close the firestore client connection
 func (f *fsDataPlatform) close() error {
 	if err := f.client.Close(); err != nil {
@@ -80,26 +305,113 @@ func (f *fsDataPlatform) close() error {
 	return nil
 }
 
-func newFSPlatform(ctx context.Context, p *dataConnParam) (*fsDataPlatform, error) {
+// newFSPlatform creates the Firestore client and returns a type that satisfies the dataplatform interface.
+// A project path lists the top level collections and a document path ending in _collections lists
+// the subcollections of the document.
+func newFSPlatform(ctx context.Context, p *dataConnParam) (dataPlatform, error) {
 	// Validate the connection parameters.
 	if err := validateFSConnectionParams(p); err != nil {
 		return nil, err
 	}
 
-	// Create the connection to Firestore.
-	client, err := firestore.NewClient(ctx, p.connectionParams[0])
+	cfg, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Select the value encoding requested with the types query parameter.
+	enc, err := newFSEncoder(p.query, p.connectionParams[0])
+	if err != nil {
+		return nil, err
+	}
+
+	// Project paths and the _collections suffix are discovery requests.
+	items := p.connectionParams[1:]
+	if len(items) == 0 || items[len(items)-1] == listCollectionsParam {
+		if len(items) > 0 {
+			items = items[:len(items)-1]
+		}
+		client, err := newFSClient(ctx, p)
+		if err != nil {
+			return nil, err
+		}
+		return &fsCollectionList{
+			client:    client,
+			projectID: p.connectionParams[0],
+			docPath:   strings.Join(items, "/"),
+		}, nil
+	}
+
+	// The docid parameter renames the injected document id field so it does not collide with a real field.
+	docIDKey := p.query.Get("docid")
+	if docIDKey == "" {
+		docIDKey = "docid"
+	}
+
+	// Firestore document pattern is collection/doc/collection/doc... if the item path is even then we know
+	// it is not a doc and the collection get logic applies.
+	isDoc := len(p.connectionParams[1:])%2 == 0
+
+	// The meta parameter places the document metadata in the body or, for single documents, the headers.
+	meta := p.query.Get("meta")
+	switch {
+	case meta == "" || meta == "body":
+	case meta == "headers" && isDoc:
+	case meta == "headers":
+		return nil, &statusError{http.StatusBadRequest, errors.New(`meta "headers" is only supported for single document reads`)}
+	default:
+		return nil, &statusError{http.StatusBadRequest, fmt.Errorf(`unknown meta %q: "body" and "headers" are supported`, meta)}
+	}
+
+	// Collections can be exported to Cloud Storage as newline delimited JSON.
+	exp, err := newExportTarget(p.query, "json")
+	if err == nil && exp != nil && isDoc {
+		err = &statusError{http.StatusBadRequest, errors.New("export is only supported for collections")}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The options are valid, so create the connection to Firestore.
+	client, err := newFSClient(ctx, p)
+	if err != nil {
+		return nil, err
+	}
 
 	return &fsDataPlatform{
 		client: client,
-
-		// Firestore document pattern is collection/doc/collection/doc... if the item path is even then we know
-		// it is not a doc and the collection get logic applies.
-		isDoc: len(p.connectionParams[1:])%2 == 0,
+		isDoc:  isDoc,
 
 		// Join the Firestore doc path from the parsed parameters.
 		itemPath: strings.Join(p.connectionParams[1:], "/"),
-	}, err
 
+		encoder:  enc,
+		merge:    p.query.Get("merge") == "true",
+		docIDKey: docIDKey,
+		meta:     meta,
+		export:   exp,
+		mask:     p.mask,
+		filters:  p.filters,
+
+		allowWrites: cfg.Firestore.AllowWrites,
+	}, nil
+
+}
+
+// newFSClient creates the connection to Firestore with the credentials selected for the request.
+func newFSClient(ctx context.Context, p *dataConnParam) (*firestore.Client, error) {
+	copts, err := p.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	_, span := startSpan(ctx, "firestore client", attribute.String("gcp.project_id", p.connectionParams[0]))
+	client, err := firestore.NewClient(ctx, p.connectionParams[0], copts...)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	clientsCreated.WithLabelValues("firestore").Inc()
+	return client, nil
 }
 
 // validateConnectionParams is a basic len check of the parameters.
@@ -108,5 +420,270 @@ func validateFSConnectionParams(p *dataConnParam) error {
 	if len(p.connectionParams) < 1 {
 		return errors.New("the url path must be in the form https://host/fs/project/collection/doc/collection/doc")
 	}
+	for _, s := range p.connectionParams {
+		if s == "" {
+			return errors.New("the url path must not contain empty segments")
+		}
+	}
+
+	// Subcollections can only be listed for a document, which has an even number of path items.
+	items := p.connectionParams[1:]
+	if len(items) > 0 && items[len(items)-1] == listCollectionsParam && len(items[:len(items)-1])%2 != 0 {
+		return errors.New("the url path must be in the form https://host/fs/project/collection/doc/_collections")
+	}
 	return nil
 }
+
+// fsEncoder converts between Firestore values and JSON. In typed mode the values that JSON can not represent are
+// wrapped in single key objects so they can be decoded without loss:
+//
+//	{"__ref__": "projects/p/databases/(default)/documents/collection/doc"}
+//	{"__time__": "2024-01-02T03:04:05.123456Z"}
+//	{"__geo__": {"latitude": 1.5, "longitude": 2.5}}
+//	{"__bytes__": "aGk="}
+//	{"__int__": "9007199254740993"}   integers beyond the +/-2^53 range that JavaScript numbers can hold
+//	{"__double__": "NaN"}             NaN and the infinities
+//
+// Doubles are always written with a decimal point or exponent so they decode as doubles. In plain mode
+// references are written as gcp-data-drive paths, timestamps as RFC 3339 strings, bytes as base64 strings
+// and geopoints as latitude/longitude objects.
+type fsEncoder struct {
+	// typed selects the lossless typed JSON form.
+	typed bool
+
+	// projectID is used to build the gcp-data-drive path of document references in plain mode.
+	projectID string
+}
+
+// maxSafeInt is the largest integer that a JavaScript number holds exactly.
+const maxSafeInt = 1<<53 - 1
+
+// newFSEncoder returns the encoder selected by the types (typed or plain) query parameter. A nil encoder
+// is returned when no types parameter is given.
+func newFSEncoder(q url.Values, projectID string) (*fsEncoder, error) {
+	switch q.Get("types") {
+	case "":
+		return nil, nil
+	case "plain":
+		return &fsEncoder{projectID: projectID}, nil
+	case "typed":
+		return &fsEncoder{typed: true, projectID: projectID}, nil
+	}
+	return nil, fmt.Errorf(`unknown types %q: "typed" and "plain" are supported`, q.Get("types"))
+}
+
+// encodeDoc converts the document data into JSON friendly values.
+func (e *fsEncoder) encodeDoc(data map[string]interface{}) (map[string]interface{}, error) {
+	v, err := e.encodeValue(data)
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+// encodeValue converts a single Firestore value.
+func (e *fsEncoder) encodeValue(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case nil, bool, string:
+		return t, nil
+
+	case int64:
+		if e.typed && (t > maxSafeInt || t < -maxSafeInt) {
+			return map[string]interface{}{"__int__": strconv.FormatInt(t, 10)}, nil
+		}
+		return t, nil
+
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			s := strconv.FormatFloat(t, 'g', -1, 64)
+			if e.typed {
+				return map[string]interface{}{"__double__": s}, nil
+			}
+			return s, nil
+		}
+		if e.typed {
+			s := strconv.FormatFloat(t, 'g', -1, 64)
+			if !strings.ContainsAny(s, ".eE") {
+				s += ".0"
+			}
+			return json.RawMessage(s), nil
+		}
+		return t, nil
+
+	case []byte:
+		s := base64.StdEncoding.EncodeToString(t)
+		if e.typed {
+			return map[string]interface{}{"__bytes__": s}, nil
+		}
+		return s, nil
+
+	case time.Time:
+		s := t.UTC().Format(time.RFC3339Nano)
+		if e.typed {
+			return map[string]interface{}{"__time__": s}, nil
+		}
+		return s, nil
+
+	case *latlng.LatLng:
+		g := map[string]interface{}{"latitude": t.Latitude, "longitude": t.Longitude}
+		if e.typed {
+			return map[string]interface{}{"__geo__": g}, nil
+		}
+		return g, nil
+
+	case *firestore.DocumentRef:
+		if e.typed {
+			return map[string]interface{}{"__ref__": t.Path}, nil
+		}
+		return drivePath("fs", e.projectID, fsRelativePath(t.Path)), nil
+
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i, item := range t {
+			ev, err := e.encodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = ev
+		}
+		return res, nil
+
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			ev, err := e.encodeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = ev
+		}
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("unsupported firestore value type %T", v)
+}
+
+// decodeDoc parses a JSON object write body into Firestore document data.
+func (e *fsEncoder) decodeDoc(client *firestore.Client, body []byte) (map[string]interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+
+	var data map[string]interface{}
+	if err := d.Decode(&data); err != nil {
+		return nil, fmt.Errorf("the request body must be a JSON object: %v", err)
+	}
+
+	v, err := e.decodeValue(client, data)
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+// decodeValue converts a single JSON value into a Firestore value. Numbers without a decimal point or exponent
+// are integers.
+func (e *fsEncoder) decodeValue(client *firestore.Client, v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case json.Number:
+		if !strings.ContainsAny(string(t), ".eE") {
+			if i, err := t.Int64(); err == nil {
+				return i, nil
+			}
+		}
+		return t.Float64()
+
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i, item := range t {
+			dv, err := e.decodeValue(client, item)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = dv
+		}
+		return res, nil
+
+	case map[string]interface{}:
+		if e.typed && len(t) == 1 {
+			for k, item := range t {
+				if strings.HasPrefix(k, "__") && strings.HasSuffix(k, "__") {
+					return decodeTypedValue(client, k, item)
+				}
+			}
+		}
+
+		res := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			dv, err := e.decodeValue(client, item)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = dv
+		}
+		return res, nil
+	}
+
+	return v, nil
+}
+
+// decodeTypedValue converts one of the reserved typed JSON objects into its Firestore value.
+func decodeTypedValue(client *firestore.Client, key string, v interface{}) (interface{}, error) {
+	if key == "__geo__" {
+		g, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("__geo__ must be an object with latitude and longitude")
+		}
+		lat, latErr := toFloat(g["latitude"])
+		lng, lngErr := toFloat(g["longitude"])
+		if latErr != nil || lngErr != nil {
+			return nil, errors.New("__geo__ must be an object with latitude and longitude")
+		}
+		return &latlng.LatLng{Latitude: lat, Longitude: lng}, nil
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a string", key)
+	}
+
+	switch key {
+	case "__ref__":
+		ref := client.Doc(fsRelativePath(s))
+		if ref == nil {
+			return nil, fmt.Errorf("__ref__ %q is not a document path", s)
+		}
+		return ref, nil
+
+	case "__time__":
+		return time.Parse(time.RFC3339Nano, s)
+
+	case "__bytes__":
+		return base64.StdEncoding.DecodeString(s)
+
+	case "__int__":
+		return strconv.ParseInt(s, 10, 64)
+
+	case "__double__":
+		return strconv.ParseFloat(s, 64)
+	}
+
+	return nil, fmt.Errorf("unknown typed value %s", key)
+}
+
+// toFloat converts a decoded JSON number to a float64.
+func toFloat(v interface{}) (float64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, errors.New("not a number")
+	}
+	return n.Float64()
+}
+
+// fsRelativePath strips the projects/p/databases/d/documents prefix from a Firestore resource name.
+func fsRelativePath(path string) string {
+	const marker = "/documents/"
+	if i := strings.Index(path, marker); i >= 0 {
+		return path[i+len(marker):]
+	}
+	return path
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/type/latlng"
+)
+
+func TestFSEncoderRoundTrip(t *testing.T) {
+	client, err := firestore.NewClient(context.Background(), "project", option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("firestore.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	data := map[string]interface{}{
+		"ref":    client.Doc("users/alice"),
+		"at":     time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC),
+		"where":  &latlng.LatLng{Latitude: 1.5, Longitude: -2.5},
+		"raw":    []byte("hi"),
+		"count":  int64(42),
+		"big":    int64(math.MaxInt64),
+		"ratio":  float64(2),
+		"nan":    math.NaN(),
+		"tags":   []interface{}{"a", int64(1)},
+		"nested": map[string]interface{}{"ok": true, "none": nil},
+	}
+
+	e := &fsEncoder{typed: true, projectID: "project"}
+	enc, err := e.encodeDoc(data)
+	if err != nil {
+		t.Fatalf("encodeDoc: unexpected error %v", err)
+	}
+	bts, err := json.Marshal(enc)
+	if err != nil {
+		t.Fatalf("json.Marshal: unexpected error %v", err)
+	}
+
+	have, err := e.decodeDoc(client, bts)
+	if err != nil {
+		t.Fatalf("decodeDoc(%s): unexpected error %v", bts, err)
+	}
+
+	// NaN never compares equal so it is checked separately.
+	if f, ok := have["nan"].(float64); !ok || !math.IsNaN(f) {
+		t.Errorf("decodeDoc(%s): nan = %v Want: NaN", bts, have["nan"])
+	}
+	delete(have, "nan")
+	delete(data, "nan")
+
+	if have["ref"].(*firestore.DocumentRef).Path != data["ref"].(*firestore.DocumentRef).Path {
+		t.Errorf("decodeDoc(%s): ref = %v Want: %v", bts, have["ref"], data["ref"])
+	}
+	delete(have, "ref")
+	delete(data, "ref")
+
+	if !reflect.DeepEqual(have, data) {
+		t.Errorf("decodeDoc(%s)\nHave:\n%#v\nWant:\n%#v", bts, have, data)
+	}
+}
+
+func TestFSEncoderPlain(t *testing.T) {
+	client, err := firestore.NewClient(context.Background(), "project", option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("firestore.NewClient: %v", err)
+	}
+	defer client.Close()
+
+	data := map[string]interface{}{
+		"ref":   client.Doc("users/alice"),
+		"at":    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		"raw":   []byte("hi"),
+		"where": &latlng.LatLng{Latitude: 1.5, Longitude: -2.5},
+		"ratio": float64(2),
+	}
+
+	e := &fsEncoder{projectID: "project"}
+	enc, err := e.encodeDoc(data)
+	if err != nil {
+		t.Fatalf("encodeDoc: unexpected error %v", err)
+	}
+	have, _ := json.Marshal(enc)
+
+	want := `{"at":"2024-01-02T03:04:05Z","ratio":2,"raw":"aGk=","ref":"/fs/project/users/alice","where":{"latitude":1.5,"longitude":-2.5}}`
+	if string(have) != want {
+		t.Errorf("encodeDoc()\nHave:\n%s\nWant:\n%s", have, want)
+	}
+}
+
+func TestFSDecodeDocErrors(t *testing.T) {
+	var tests = []string{
+		`[1, 2]`,
+		`{"at": {"__time__": "yesterday"}}`,
+		`{"where": {"__geo__": "here"}}`,
+		`{"x": {"__unknown__": "1"}}`,
+	}
+
+	e := &fsEncoder{typed: true}
+	for _, in := range tests {
+		if _, err := e.decodeDoc(nil, []byte(in)); err == nil {
+			t.Errorf("decodeDoc(%s): An error was expected but no error was returned", in)
+		}
+	}
+}
+
+func TestFSWritesDisabled(t *testing.T) {
+	f := &fsDataPlatform{itemPath: "users/alice", isDoc: true}
+	for _, method := range []string{http.MethodPut, http.MethodPost} {
+		if _, err := f.putData(context.Background(), method, []byte(`{"name": "alice"}`)); errorStatus(err) != http.StatusMethodNotAllowed {
+			t.Errorf("putData(%s) error = %v Want: 405 Method Not Allowed", method, err)
+		}
+	}
+}
@@ -17,8 +17,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 // dataPlatform defines the methods needed for consumtion by the web serving handler.
@@ -28,76 +32,383 @@ type dataPlatform interface {
 	close() error
 }
 
+// dataHeaders is implemented by data platforms that report response headers once getData or putData returns.
+type dataHeaders interface {
+	headers() http.Header
+}
+
+// dataStatus is implemented by data platforms that respond with a status other than 200 OK, such as 202 Accepted.
+type dataStatus interface {
+	status() int
+}
+
+// dataWriter is implemented by data platforms that accept a request body on POST and PUT requests.
+type dataWriter interface {
+	// putData consumes the request body and returns the slice of bytes of the marshaled response.
+	putData(ctx context.Context, method string, body []byte) ([]byte, error)
+}
+
+// maxBodyBytes limits the size of the request bodies accepted by a dataWriter.
+const maxBodyBytes = 10 << 20
+
+// statusError is an error that carries the HTTP status code that should be returned to the caller.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// errorStatus returns the HTTP status code for err. Errors without a status are internal server errors.
+func errorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	return http.StatusInternalServerError
+}
+
+// GetJSONData serves a request and records its metrics.
 func GetJSONData(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if cfg, err := getConfig(); err == nil {
+		initTracing(&cfg.Tracing)
+	}
+	ctx, span := startRequestSpan(r)
+	ctx, labels := withRequestLabels(ctx)
+	mw := &metricsWriter{ResponseWriter: w}
+	serveJSONData(mw, r.WithContext(ctx), labels)
+	observeRequest(labels, mw, time.Since(start).Seconds())
+	endRequestSpan(span, r, labels, mw.status())
+}
+
+// serveJSONData fulfills the request with the data platform named by the path.
+func serveJSONData(w http.ResponseWriter, r *http.Request, labels *requestLabels) {
+	cfg, err := getConfig()
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// Verify the Media CDN signature of signed links.
+	r, err = verifySignedRequest(r, &cfg.SignedRequests, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Verify the bearer token of the caller.
+	r, err = authenticate(r, &cfg.Auth)
+	if err != nil {
+		if errorStatus(err) == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		}
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Look up the API key of the caller.
+	r, err = authenticateKey(r, &cfg.APIKeys)
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Check that the caller may use the method on the path.
+	if err := authorize(r, &cfg.Authz); err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// The Prometheus metrics are served at /metrics.
+	if r.URL.Path == metricsPath {
+		serveMetrics(w, r)
+		return
+	}
+
+	// The usage of the API keys is reported by GET /_usage.
+	if strings.Trim(r.URL.Path, "/") == usageParam {
+		serveUsage(w, r, &cfg.APIKeys)
+		return
+	}
+
+	// Cached responses are invalidated with DELETE /_cache/{path}.
+	if strings.HasPrefix(r.URL.Path, "/"+cacheParam+"/") {
+		serveInvalidate(w, r, &cfg.Cache)
+		return
+	}
+
+	// Requests made with an API key are limited to the routes and quotas of the key.
+	k := requestAPIKey(r.Context())
+	if k != nil {
+		if err := admitKey(r.Context(), k, getUsageStore(&cfg.APIKeys), r.URL.Path, time.Now()); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
 	// Parse the request URL.
+	_, span := startSpan(r.Context(), "parse request")
 	conParams, err := parseDDURL(r)
+	endSpan(span, err)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	labels.set(conParams, cfg)
 
-	// Parse the platform interface from the URL path.
-	pd, err := parseDataPlatform(r.Context(), conParams)
-	defer pd.close()
+	// Use the access token of the caller for the data platform when passthrough is enabled.
+	conParams.token, err = accessToken(r, &cfg.Passthrough)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
+	// Select the fields of the results that are redacted for the caller.
+	conParams.mask, err = newMasker(cfg.Masking, r.URL.Path, requestPrincipal(r))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Bind the row filters of the path to the claims of the caller.
+	conParams.filters, err = bindRowFilters(cfg.RowFilters, r.URL.Path, requestIdentity(r.Context()))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// Serve the response from the cache when a TTL applies to the path.
+	key, ttl := cachePolicy(r, conParams, &cfg.Cache)
+	if ttl > 0 {
+		e, err := getCache(&cfg.Cache).load(r.Context(), key)
+		if err != nil {
+			log.Printf("cache: loading %s: %v", key, err)
+		}
+		if e != nil {
+			cacheRequests.WithLabelValues(contextRoute(r.Context()), "hit").Inc()
+			if k != nil {
+				recordUsage(r.Context(), getUsageStore(&cfg.APIKeys), k, e.body, time.Now())
+			}
+			writeResponse(w, r, e, 0, ttl, conParams.personal())
+			return
+		}
+		cacheRequests.WithLabelValues(contextRoute(r.Context()), "miss").Inc()
+	}
+
+	fetch := func(ctx context.Context) (*cacheEntry, int, error) {
+		e, code, err := fetchResponse(ctx, r, conParams)
+		if err == nil && ttl > 0 && code == 0 {
+			if err := getCache(&cfg.Cache).store(ctx, key, e, ttl); err != nil {
+				log.Printf("cache: storing %s: %v", key, err)
+			}
+		}
+		return e, code, err
+	}
+
+	// Identical concurrent reads share a single call to the data platform.
+	var e *cacheEntry
+	var code int
+	if key != "" {
+		e, code, err = flights.do(r.Context(), key, fetch)
+	} else {
+		e, code, err = fetch(r.Context())
+	}
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	// A write makes the cached reads of what it changed stale.
+	if prefix := writeInvalidation(r, conParams); prefix != "" {
+		if err := getCache(&cfg.Cache).invalidate(r.Context(), prefix); err != nil {
+			log.Printf("cache: invalidating %s: %v", prefix, err)
+		}
+	}
+
+	// Count the rows and bytes returned against the quota of the API key.
+	if k != nil {
+		recordUsage(r.Context(), getUsageStore(&cfg.APIKeys), k, e.body, time.Now())
+	}
+
+	writeResponse(w, r, e, code, ttl, conParams.personal())
+}
+
+// fetchResponse fulfills the request with the data platform and returns the response entry and the status reported
+// by the data platform.
+func fetchResponse(ctx context.Context, r *http.Request, p *dataConnParam) (*cacheEntry, int, error) {
+	// Parse the platform interface from the URL path.
+	pd, err := parseDataPlatform(ctx, p)
+	if err != nil {
+		return nil, 0, p.tokenError(err)
+	}
+	defer pd.close()
+
 	// Get the []byte results from the requested data platfrom.
-	bts, err := pd.getData(r.Context())
+	bts, err := serveData(ctx, r, pd)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		return nil, 0, p.tokenError(err)
+	}
+
+	// Collect any headers and status reported by the data platform.
+	var header http.Header
+	if dh, ok := pd.(dataHeaders); ok {
+		header = dh.headers()
+	}
+	var code int
+	if ds, ok := pd.(dataStatus); ok {
+		code = ds.status()
+	}
+	return newCacheEntry(bts, header), code, nil
+}
+
+// writeResponse writes the response entry with its ETag. A GET whose If-None-Match header matches the ETag is
+// answered with 304 Not Modified. Responses that may be cached carry a Cache-Control header so that Cloud CDN
+// can cache them too. Personal responses, which depend on who the caller is, are only cached by the caller.
+func writeResponse(w http.ResponseWriter, r *http.Request, e *cacheEntry, code int, ttl time.Duration, personal bool) {
+	// Copy any headers reported by the data platform.
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", e.etag)
+	w.Header().Add("Vary", "Authorization")
+	switch {
+	case ttl > 0 && personal:
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(ttl.Seconds())))
+	case ttl > 0:
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(ttl.Seconds())))
+	case personal:
+		w.Header().Set("Cache-Control", "private")
+	}
+
+	if code == 0 && (r.Method == http.MethodGet || r.Method == http.MethodHead) && ifNoneMatch(r, e.etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	// Setting the default content-type header to JSON.
 	w.Header().Add("Content-Type", "application/json")
 
+	// Write the status reported by the data platform.
+	if code != 0 {
+		w.WriteHeader(code)
+	}
+
 	// Writing the bytes to the IO writer.
-	w.Write(bts)
+	w.Write(e.body)
+}
 
+// serveData dispatches the request to the data platform based on the HTTP method. POST and PUT requests write to
+// the data platforms that support writes and every other request reads.
+func serveData(ctx context.Context, r *http.Request, pd dataPlatform) ([]byte, error) {
+	if dw, ok := pd.(dataWriter); ok && (r.Method == http.MethodPost || r.Method == http.MethodPut) {
+		body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodyBytes))
+		if err != nil {
+			return nil, &statusError{http.StatusRequestEntityTooLarge, err}
+		}
+		return dw.putData(ctx, r.Method, body)
+	}
+	return pd.getData(ctx)
 }
 
 // parseDataPlatform detects the requested data platform and returns an interface to specified data platform.
 func parseDataPlatform(ctx context.Context, p *dataConnParam) (dataPlatform, error) {
+	var pd dataPlatform
+	var err error
 	switch p.platform {
 	case "bq":
-		return newBQPlatform(ctx, p)
+		pd, err = newBQPlatform(ctx, p)
 
 	case "fs":
-		return newFSPlatform(ctx, p)
+		pd, err = newFSPlatform(ctx, p)
 
+	case "q":
+		pd, err = newSavedQueryPlatform(ctx, p)
+
+	default:
+		return nil, fmt.Errorf(`unknown data platform %q: bigquery ("bq"), firestore ("fs") and saved queries ("q") supported`, p.platform)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, fmt.Errorf(`unknown data platform %q: bigquery ("bq") and firestore ("fs") supported`, p.platform)
+	// Requests with a callback are fulfilled in the background.
+	cp, err := newCallbackPlatform(pd, p)
+	if err != nil {
+		pd.close()
+		return nil, err
+	}
+	return cp, nil
 }
 
 // dataConnParam provides parsed parameters from the requested URL path.
 type dataConnParam struct {
-	// platfrom is a charter indicator of the target platform. Accepted values are (bq,fs).
+	// platfrom is a charter indicator of the target platform. Accepted values are (bq,fs,q).
 	platform string
 
 	// connectionParams is the remaining path from the url request split on a "/" charter.
 	connectionParams []string
+
+	// query holds the url query parameters that tune how the data platform fulfills the request.
+	query url.Values
+
+	// caller identifies the caller in the labels of the jobs run for the request. It is empty for anonymous
+	// requests.
+	caller string
+
+	// token is the OAuth access token of the caller used for the data platform clients. It is empty when the
+	// request runs as the service account.
+	token string
+
+	// mask redacts the fields of the results that the masking rules hide from the caller.
+	mask *masker
+
+	// filters restrict the rows and documents to those matching the claims of the caller.
+	filters []boundFilter
+}
+
+// personal reports whether the response depends on the caller: its identity, API key or access token, or the
+// masks and row filters that apply to it.
+func (p *dataConnParam) personal() bool {
+	return p.caller != "" || p.token != "" || p.mask != nil || len(p.filters) > 0
+}
+
+// requestCaller returns the caller verified from the bearer token or the signed header of Identity-Aware Proxy, or
+// apikey:{name} for requests made with an API key.
+func requestCaller(r *http.Request) string {
+	if id := requestIdentity(r.Context()); id != nil {
+		return id.name()
+	}
+	if k := requestAPIKey(r.Context()); k != nil {
+		return apiKeyPrefix + k.Name
+	}
+	return ""
 }
 
 // parseDDURL detects and shapes the data platfrom request.
 func parseDDURL(r *http.Request) (*dataConnParam, error) {
-	// Trimming the leading prefix and split the path in to an array.
-	location := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
-	if len(location) < 3 {
-		return nil, errors.New("BadAPIRequest  Please provide a request in the following pattern\nhttps://<<hostname>>/<<data-gcp-project-target>>/platfromid/<<platform parameter 1>>/<<platform parameter 2>>")
+	// Trimming the leading and trailing slashes and split the path in to an array.
+	location := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(location) < 2 {
+		return nil, errors.New("BadAPIRequest  Please provide a request in the following pattern\nhttps://<<hostname>>/platfromid/<<data-gcp-project-target>>/<<platform parameter 1>>/<<platform parameter 2>>")
 	}
 
 	// This switch statement is used to allow easy implementation of additional dat platform providers.
 	switch location[0] {
-	case "bq", "fs":
+	case "bq", "fs", "q":
 		return &dataConnParam{
 			platform:         location[0],
 			connectionParams: location[1:],
+			query:            r.URL.Query(),
+			caller:           requestCaller(r),
 		}, nil
 
 	}
-	return nil, errors.New(`UnknownDataPlatform: bigquery ("bq") and firestore ("fs") are the only support platform types at this time`)
+	return nil, errors.New(`UnknownDataPlatform: bigquery ("bq"), firestore ("fs") and saved queries ("q") are the only support platform types at this time`)
 }
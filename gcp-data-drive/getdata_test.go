@@ -16,7 +16,9 @@ package gcpdatadrive
 
 import (
 	"context"
+	"errors"
 	"net/http"
+	"net/url"
 	"reflect"
 	"testing"
 )
@@ -36,16 +38,20 @@ func TestParseDDURL(t *testing.T) {
 			false,
 		},
 		{"https://example.com/bq/project",
-			nil,
-			true,
+			&dataConnParam{platform: "bq", connectionParams: []string{"project"}, query: url.Values{}},
+			false,
+		},
+		{"https://example.com/bq/project/dataset/",
+			&dataConnParam{platform: "bq", connectionParams: []string{"project", "dataset"}, query: url.Values{}},
+			false,
 		},
 
 		{"https://example.com/bq/project/dataset/view",
-			&dataConnParam{platform: "bq", connectionParams: []string{"project", "dataset", "view"}},
+			&dataConnParam{platform: "bq", connectionParams: []string{"project", "dataset", "view"}, query: url.Values{}},
 			false,
 		},
 		{"https://example.com/fs/project/collection/document",
-			&dataConnParam{platform: "fs", connectionParams: []string{"project", "collection", "document"}},
+			&dataConnParam{platform: "fs", connectionParams: []string{"project", "collection", "document"}, query: url.Values{}},
 			false,
 		},
 	}
@@ -72,10 +78,15 @@ func TestParseDDURL(t *testing.T) {
 
 func TestParseDataPlatfrom(t *testing.T) {
 	var platformDetectTests = []struct {
-		in string
+		in   string
+		want dataPlatform
 	}{
-		{"https://example.com/bq/project/dataset/view"},
-		{"https://example.com/fs/project/collection/document"},
+		{"https://example.com/bq/project/dataset/view", &bqDataPlatform{}},
+		{"https://example.com/bq/project/dataset", &bqTableList{}},
+		{"https://example.com/bq/project", &bqDatasetList{}},
+		{"https://example.com/fs/project/collection/document", &fsDataPlatform{}},
+		{"https://example.com/fs/project", &fsCollectionList{}},
+		{"https://example.com/fs/project/collection/document/_collections", &fsCollectionList{}},
 	}
 
 	for _, item := range platformDetectTests {
@@ -94,17 +105,149 @@ func TestParseDataPlatfrom(t *testing.T) {
 			t.Errorf("parseDataPlatform(): Expecting no errors in the test but have %v", err)
 		}
 
-		if pd.platform == "bq" {
-			if _, ok := have.(*bqDataPlatform); !ok {
-				t.Errorf("parseDataPlatform(context,%+v) = %T Want:*bqDataPlatform", pd, have)
+		if reflect.TypeOf(have) != reflect.TypeOf(item.want) {
+			t.Errorf("parseDataPlatform(context,%+v) = %T Want:%T", pd, have, item.want)
+		}
+	}
+
+}
+
+func TestParseDataPlatformErrors(t *testing.T) {
+	var tests = []string{
+		"https://example.com/bq/project/dataset/view/extra",
+		"https://example.com/bq/project//view",
+		"https://example.com/fs/project/collection/_collections",
+	}
+
+	for _, in := range tests {
+		req, err := http.NewRequest("GET", in, nil)
+		if err != nil {
+			t.Errorf("parseDataPlatform() Error creating fake http request.")
+		}
+
+		pd, err := parseDDURL(req)
+		if err != nil {
+			t.Errorf("parseDataPlatform() Error parsing the parameters in the URL")
+		}
+
+		if _, err := parseDataPlatform(context.Background(), pd); err == nil {
+			t.Errorf("parseDataPlatform(context,%+v): An error was expected but no error was returned", pd)
+		}
+	}
+}
+
+func TestFSPlatformOptions(t *testing.T) {
+	var tests = []struct {
+		in       string
+		docIDKey string
+		meta     string
+		code     int
+	}{
+		{"https://example.com/fs/project/collection", "docid", "", 0},
+		{"https://example.com/fs/project/collection?docid=_id&meta=body", "_id", "body", 0},
+		{"https://example.com/fs/project/collection/document?meta=headers", "docid", "headers", 0},
+		{"https://example.com/fs/project/collection?meta=headers", "", "", http.StatusBadRequest},
+		{"https://example.com/fs/project/collection?meta=footer", "", "", http.StatusBadRequest},
+	}
+
+	for _, item := range tests {
+		req, err := http.NewRequest("GET", item.in, nil)
+		if err != nil {
+			t.Errorf("newFSPlatform() Error creating fake http request.")
+		}
+
+		pd, err := parseDDURL(req)
+		if err != nil {
+			t.Errorf("newFSPlatform() Error parsing the parameters in the URL")
+		}
+
+		// Invalid options are rejected before a client is created.
+		have, err := newFSPlatform(context.Background(), pd)
+		if item.code != 0 {
+			var se *statusError
+			if !errors.As(err, &se) || se.code != item.code {
+				t.Errorf("newFSPlatform(context,%+v) error = %v Want: status %d", pd, err, item.code)
 			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newFSPlatform(context,%+v): Expecting no errors in the test but have %v", pd, err)
+			continue
+		}
+
+		f := have.(*fsDataPlatform)
+		if f.docIDKey != item.docIDKey || f.meta != item.meta {
+			t.Errorf("newFSPlatform(context,%+v) = docIDKey %q meta %q Want: docIDKey %q meta %q", pd, f.docIDKey, f.meta, item.docIDKey, item.meta)
+		}
+	}
+}
+
+func TestBQJobPaths(t *testing.T) {
+	var tests = []struct {
+		in      string
+		jobID   string
+		results bool
+		code    int
+	}{
+		{"https://example.com/bq/project/dataset/view/_jobs", "", false, 0},
+		{"https://example.com/bq/project/dataset/view/_jobs/job_123?location=EU", "job_123", false, 0},
+		{"https://example.com/bq/project/dataset/view/_jobs/job_123/results?maxResults=10&pageToken=abc", "job_123", true, 0},
+		{"https://example.com/bq/project/dataset/view/_jobs/job_123/rows", "", false, http.StatusBadRequest},
+		{"https://example.com/bq/project/dataset/view/_other", "", false, http.StatusBadRequest},
+		{"https://example.com/bq/project/dataset/view/_jobs/job_123/results?maxResults=0", "", false, http.StatusBadRequest},
+		{"https://example.com/bq/project/dataset/view/_jobs/job_123/results?maxResults=ten", "", false, http.StatusBadRequest},
+	}
+
+	for _, item := range tests {
+		req, err := http.NewRequest("GET", item.in, nil)
+		if err != nil {
+			t.Errorf("newBQPlatform() Error creating fake http request.")
+		}
+
+		pd, err := parseDDURL(req)
+		if err != nil {
+			t.Errorf("newBQPlatform() Error parsing the parameters in the URL")
 		}
 
-		if pd.platform == "fs" {
-			if _, ok := have.(*fsDataPlatform); !ok {
-				t.Errorf("parseDataPlatform(context,%+v) = %T Want:*fsDataPlatform", pd, have)
+		// Invalid paths and paging parameters are rejected before a client is created.
+		have, err := newBQPlatform(context.Background(), pd)
+		if item.code != 0 {
+			var se *statusError
+			if !errors.As(err, &se) || se.code != item.code {
+				t.Errorf("newBQPlatform(context,%+v) error = %v Want: status %d", pd, err, item.code)
 			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("newBQPlatform(context,%+v): Expecting no errors in the test but have %v", pd, err)
+			continue
+		}
+
+		j, ok := have.(*bqJobPlatform)
+		if !ok {
+			t.Errorf("newBQPlatform(context,%+v) = %T Want:*bqJobPlatform", pd, have)
+			continue
+		}
+		if j.jobID != item.jobID || j.results != item.results {
+			t.Errorf("newBQPlatform(context,%+v) = jobID %q results %v Want: jobID %q results %v", pd, j.jobID, j.results, item.jobID, item.results)
 		}
 	}
+}
 
+// readOnlyPlatform is a data platform without writes that returns an empty array.
+type readOnlyPlatform struct{}
+
+func (readOnlyPlatform) getData(ctx context.Context) ([]byte, error) { return []byte("[]"), nil }
+func (readOnlyPlatform) close() error                                { return nil }
+
+func TestServeDataMethods(t *testing.T) {
+	// Platforms without writes serve every method as a read.
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch}
+	for _, m := range methods {
+		r, _ := http.NewRequest(m, "https://example.com/bq/p/d/v", nil)
+		bts, err := serveData(context.Background(), r, readOnlyPlatform{})
+		if err != nil || string(bts) != "[]" {
+			t.Errorf("serveData(%s) = %s, %v Want: the read", m, bts, err)
+		}
+	}
 }
@@ -0,0 +1,69 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+)
+
+// cloudPlatformScope is the OAuth scope of the impersonated tokens.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+var (
+	// impersonatedMu guards impersonatedSources, the process wide token sources keyed by the service account and
+	// its delegates. The sources cache their tokens until they are about to expire.
+	impersonatedMu      sync.Mutex
+	impersonatedSources = map[string]oauth2.TokenSource{}
+)
+
+// impersonation returns the impersonation route of the first route matching path, or nil when the path is read
+// with the credentials of the service.
+func (c *config) impersonation(path string) *impersonationRoute {
+	for i := range c.Impersonation {
+		if routeMatches(c.Impersonation[i].Route, path) {
+			return &c.Impersonation[i]
+		}
+	}
+	return nil
+}
+
+// impersonatedTokenSource returns the token source that mints tokens for the service account of the route.
+func impersonatedTokenSource(r *impersonationRoute) (oauth2.TokenSource, error) {
+	key := strings.Join(append([]string{r.ServiceAccount}, r.Delegates...), ",")
+
+	impersonatedMu.Lock()
+	defer impersonatedMu.Unlock()
+	if ts, ok := impersonatedSources[key]; ok {
+		return ts, nil
+	}
+
+	// The source outlives the request that creates it so it is bound to the background context.
+	ts, err := impersonate.CredentialsTokenSource(context.Background(), impersonate.CredentialsConfig{
+		TargetPrincipal: r.ServiceAccount,
+		Delegates:       r.Delegates,
+		Scopes:          []string{cloudPlatformScope},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("impersonating %s: %v", r.ServiceAccount, err)
+	}
+	impersonatedSources[key] = ts
+	return ts, nil
+}
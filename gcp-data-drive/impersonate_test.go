@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestImpersonationRoutes(t *testing.T) {
+	var c config
+	if err := json.Unmarshal([]byte(`{"impersonation": [
+		{"route": "bq/proj/finance/*", "serviceAccount": "finance-reader@proj.iam.gserviceaccount.com"},
+		{"route": "fs/proj/events", "serviceAccount": "events@proj.iam.gserviceaccount.com", "delegates": ["hop@proj.iam.gserviceaccount.com"]}
+	]}`), &c); err != nil {
+		t.Fatalf("json.Unmarshal() error: %v", err)
+	}
+
+	var tests = []struct {
+		path string
+		want string
+	}{
+		{"/bq/proj/finance/ledger", "finance-reader@proj.iam.gserviceaccount.com"},
+		{"/fs/proj/events/doc1", "events@proj.iam.gserviceaccount.com"},
+		{"/bq/proj/reporting/sales", ""},
+	}
+
+	for _, item := range tests {
+		var have string
+		if r := c.impersonation(item.path); r != nil {
+			have = r.ServiceAccount
+		}
+		if have != item.want {
+			t.Errorf("impersonation(%q) = %q Want: %q", item.path, have, item.want)
+		}
+	}
+}
+
+func TestImpersonatedClientOptions(t *testing.T) {
+	setConfig(&config{Impersonation: []impersonationRoute{
+		{Route: "bq/proj/finance/*", ServiceAccount: "finance-reader@proj.iam.gserviceaccount.com"},
+	}})
+	defer setConfig(&config{})
+
+	p := &dataConnParam{platform: "bq", connectionParams: []string{"proj", "finance", "ledger"}}
+	copts, err := p.clientOptions()
+	if err != nil || len(copts) != 1 {
+		t.Fatalf("clientOptions(finance) = %v, %v Want: the impersonated token source", copts, err)
+	}
+
+	// Every request of the route shares the token source and its cached tokens.
+	r := &impersonationRoute{ServiceAccount: "finance-reader@proj.iam.gserviceaccount.com"}
+	ts1, err1 := impersonatedTokenSource(r)
+	ts2, err2 := impersonatedTokenSource(r)
+	if err1 != nil || err2 != nil || ts1 != ts2 {
+		t.Errorf("impersonatedTokenSource() = %v, %v Want: the same cached token source", err1, err2)
+	}
+
+	p.connectionParams = []string{"proj", "reporting", "sales"}
+	if copts, err := p.clientOptions(); err != nil || len(copts) != 0 {
+		t.Errorf("clientOptions(reporting) = %v, %v Want: the credentials of the service", copts, err)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// maskSaltEnv is the environment variable holding the secret salt of hashed fields.
+	maskSaltEnv = "GCP_DATA_DRIVE_MASK_SALT"
+
+	// defaultMaskKeep is the number of characters a partial mask leaves visible when keep is not configured.
+	defaultMaskKeep = 4
+)
+
+// maskAction is the redaction of a single field.
+type maskAction struct {
+	action string
+	keep   int
+}
+
+// masker redacts the fields of the results of a request. A nil masker leaves the results unchanged.
+type masker struct {
+	// fields maps the dotted field names to their redaction.
+	fields map[string]maskAction
+
+	// columns maps the lower-cased dotted field names to their redaction. BigQuery column names are
+	// case-insensitive, while Firestore field names are not.
+	columns map[string]maskAction
+
+	// salt is the secret key of the HMAC of hashed fields.
+	salt []byte
+
+	// key identifies the redactions so that differently masked results do not share a cache entry.
+	key string
+}
+
+// newMasker returns the masker of the rules that match the path and apply to the caller, or nil when no field is
+// redacted. The first rule naming a field decides its redaction.
+func newMasker(rules []maskRule, path string, p principal) (*masker, error) {
+	m := &masker{fields: map[string]maskAction{}, columns: map[string]maskAction{}}
+	for _, r := range rules {
+		if !routeMatches(r.Route, path) {
+			continue
+		}
+		if len(r.Principals) > 0 && !p.matches(r.Principals) || p.matches(r.Except) {
+			continue
+		}
+
+		a := maskAction{action: r.Action, keep: r.Keep}
+		switch r.Action {
+		case "drop", "null":
+		case "hash":
+			if m.salt == nil {
+				salt := os.Getenv(maskSaltEnv)
+				if salt == "" {
+					return nil, fmt.Errorf("masking %s: %s must hold the salt of hashed fields", r.Route, maskSaltEnv)
+				}
+				m.salt = []byte(salt)
+			}
+		case "partial":
+			if a.keep == 0 {
+				a.keep = defaultMaskKeep
+			}
+		default:
+			return nil, fmt.Errorf(`masking %s: unknown action %q: "drop", "null", "hash" and "partial" are supported`, r.Route, r.Action)
+		}
+		for _, f := range r.Fields {
+			if _, ok := m.fields[f]; !ok {
+				m.fields[f] = a
+			}
+			if _, ok := m.columns[strings.ToLower(f)]; !ok {
+				m.columns[strings.ToLower(f)] = a
+			}
+		}
+	}
+	if len(m.fields) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(m.fields))
+	for f, a := range m.fields {
+		keys = append(keys, f+":"+a.action+":"+strconv.Itoa(a.keep))
+	}
+	sort.Strings(keys)
+	m.key = strings.Join(keys, ",")
+	return m, nil
+}
+
+// exportError rejects the Cloud Storage exports of masked results, which BigQuery writes without passing through
+// the masker.
+func (m *masker) exportError(exp *exportTarget) error {
+	if m == nil || exp == nil {
+		return nil
+	}
+	return &statusError{http.StatusForbidden, errors.New("export is not available for results with masked fields")}
+}
+
+// maskRows returns the schema and the rows with the fields redacted. Hashed and partially masked fields become
+// STRING fields.
+func (m *masker) maskRows(schema bigquery.Schema, rows [][]bigquery.Value) (bigquery.Schema, [][]bigquery.Value) {
+	if m == nil {
+		return schema, rows
+	}
+	res := make([][]bigquery.Value, len(rows))
+	for i, row := range rows {
+		res[i] = m.maskRecord("", schema, row)
+	}
+	return m.maskSchema("", schema), res
+}
+
+// maskSchema redacts the fields of a schema or RECORD whose fields are named below prefix. The prefix is lower-cased.
+func (m *masker) maskSchema(prefix string, schema bigquery.Schema) bigquery.Schema {
+	res := make(bigquery.Schema, 0, len(schema))
+	for _, f := range schema {
+		name := prefix + strings.ToLower(f.Name)
+		a, ok := m.columns[name]
+		switch {
+		case ok && a.action == "drop":
+			continue
+
+		case ok && a.action != "null":
+			f = &bigquery.FieldSchema{Name: f.Name, Type: bigquery.StringFieldType, Repeated: f.Repeated}
+
+		case !ok && f.Schema != nil:
+			nf := *f
+			nf.Schema = m.maskSchema(name+".", f.Schema)
+			f = &nf
+		}
+		res = append(res, f)
+	}
+	return res
+}
+
+// maskRecord redacts the values of a row or RECORD whose fields are named below prefix. The prefix is lower-cased.
+func (m *masker) maskRecord(prefix string, schema bigquery.Schema, vals []bigquery.Value) []bigquery.Value {
+	res := make([]bigquery.Value, 0, len(vals))
+	for i, f := range schema {
+		if i >= len(vals) {
+			break
+		}
+		name, v := prefix+strings.ToLower(f.Name), vals[i]
+		a, ok := m.columns[name]
+		switch {
+		case ok && a.action == "drop":
+			continue
+
+		case ok:
+			v = m.maskBQField(a, f, v)
+
+		case f.Schema != nil && v != nil && f.Repeated:
+			vs, _ := v.([]bigquery.Value)
+			recs := make([]bigquery.Value, len(vs))
+			for j, rec := range vs {
+				rv, _ := rec.([]bigquery.Value)
+				recs[j] = m.maskRecord(name+".", f.Schema, rv)
+			}
+			v = recs
+
+		case f.Schema != nil && v != nil:
+			rv, _ := v.([]bigquery.Value)
+			v = m.maskRecord(name+".", f.Schema, rv)
+		}
+		res = append(res, v)
+	}
+	return res
+}
+
+// maskBQField redacts a field value, each element of a repeated field on its own.
+func (m *masker) maskBQField(a maskAction, f *bigquery.FieldSchema, v bigquery.Value) bigquery.Value {
+	if v == nil || a.action == "null" {
+		return nil
+	}
+	str := func(v bigquery.Value) bigquery.Value {
+		if rec, ok := v.([]bigquery.Value); ok && f.Schema != nil {
+			return m.maskValue(a, bqRowMap(f.Schema, rec))
+		}
+		return m.maskValue(a, v)
+	}
+	if vs, ok := v.([]bigquery.Value); ok && f.Repeated {
+		res := make([]bigquery.Value, len(vs))
+		for i, item := range vs {
+			res[i] = str(item)
+		}
+		return res
+	}
+	return str(v)
+}
+
+// maskDoc returns a copy of the Firestore document data with the fields named below prefix redacted.
+func (m *masker) maskDoc(prefix string, data map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return data
+	}
+	res := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		name := prefix + k
+		a, ok := m.fields[name]
+		switch {
+		case ok && a.action == "drop":
+			continue
+
+		case ok && a.action == "null" || ok && v == nil:
+			v = nil
+
+		case ok:
+			if vs, isArray := v.([]interface{}); isArray {
+				items := make([]interface{}, len(vs))
+				for i, item := range vs {
+					items[i] = m.maskValue(a, item)
+				}
+				v = items
+			} else {
+				v = m.maskValue(a, v)
+			}
+
+		default:
+			v = m.maskDocValue(name+".", v)
+		}
+		res[k] = v
+	}
+	return res
+}
+
+// maskDocValue redacts the fields of the maps nested in a Firestore value.
+func (m *masker) maskDocValue(prefix string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return m.maskDoc(prefix, t)
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i, item := range t {
+			res[i] = m.maskDocValue(prefix, item)
+		}
+		return res
+	}
+	return v
+}
+
+// maskValue returns the hash or the partial mask of the string form of a value.
+func (m *masker) maskValue(a maskAction, v interface{}) string {
+	s := maskString(v)
+	if a.action == "hash" {
+		h := hmac.New(sha256.New, m.salt)
+		h.Write([]byte(s))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	rs := []rune(s)
+	for i := 0; i < len(rs)-a.keep; i++ {
+		rs[i] = '*'
+	}
+	return string(rs)
+}
+
+// maskString returns the string form of a value that is hashed or partially masked.
+func maskString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case []byte:
+		return base64.StdEncoding.EncodeToString(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	case *big.Rat:
+		return formatNumeric(t, bigquery.BigNumericFieldType)
+	case *firestore.DocumentRef:
+		return t.Path
+	case map[string]bigquery.Value, map[string]interface{}, []interface{}:
+		if bts, err := json.Marshal(t); err == nil {
+			return string(bts)
+		}
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// testMaskRules hide the contact details of customers from everyone but the support group.
+var testMaskRules = []maskRule{
+	{Route: "bq/p/crm/*", Fields: []string{"ssn"}, Action: "drop"},
+	{Route: "bq/p/crm/*", Fields: []string{"email", "address.street"}, Action: "hash", Except: []string{"group:support@example.com"}},
+	{Route: "bq/p/crm/*", Fields: []string{"phone"}, Action: "partial", Except: []string{"group:support@example.com"}},
+	{Route: "fs/p/customers", Fields: []string{"email"}, Action: "null", Principals: []string{"*@partner.example.com"}},
+}
+
+func TestNewMasker(t *testing.T) {
+	os.Setenv(maskSaltEnv, "pepper")
+	defer os.Unsetenv(maskSaltEnv)
+
+	var tests = []struct {
+		path string
+		p    principal
+		want string
+	}{
+		{"/bq/p/crm/customers", principal{email: "analyst@example.com"}, "address.street:hash:0,email:hash:0,phone:partial:4,ssn:drop:0"},
+		{"/bq/p/crm/customers", principal{email: "agent@example.com", groups: []string{"support@example.com"}}, "ssn:drop:0"},
+		{"/bq/p/sales/orders", principal{}, ""},
+		{"/fs/p/customers", principal{email: "bot@partner.example.com"}, "email:null:0"},
+		{"/fs/p/customers", principal{email: "analyst@example.com"}, ""},
+	}
+
+	for _, item := range tests {
+		m, err := newMasker(testMaskRules, item.path, item.p)
+		if err != nil {
+			t.Fatalf("newMasker(%s, %v) error: %v", item.path, item.p, err)
+		}
+		var have string
+		if m != nil {
+			have = m.key
+		}
+		if have != item.want {
+			t.Errorf("newMasker(%s, %v) = %q Want: %q", item.path, item.p, have, item.want)
+		}
+	}
+
+	os.Unsetenv(maskSaltEnv)
+	if _, err := newMasker(testMaskRules, "/bq/p/crm/customers", principal{}); err == nil {
+		t.Errorf("newMasker() without a salt = nil Want: an error")
+	}
+}
+
+func TestMaskRows(t *testing.T) {
+	os.Setenv(maskSaltEnv, "pepper")
+	defer os.Unsetenv(maskSaltEnv)
+	m, err := newMasker(testMaskRules, "/bq/p/crm/customers", principal{})
+	if err != nil {
+		t.Fatalf("newMasker() error: %v", err)
+	}
+
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "ssn", Type: bigquery.StringFieldType},
+		{Name: "email", Type: bigquery.StringFieldType},
+		{Name: "phone", Type: bigquery.IntegerFieldType},
+		{Name: "address", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+			{Name: "street", Type: bigquery.StringFieldType},
+			{Name: "city", Type: bigquery.StringFieldType},
+		}},
+	}
+	rows := [][]bigquery.Value{{
+		int64(1), "123-45-6789", "ada@example.com", int64(5551234),
+		[]bigquery.Value{[]bigquery.Value{"1 Main St", "London"}},
+	}}
+
+	// Every output encoding renders the masked rows.
+	email := m.maskValue(m.fields["email"], "ada@example.com")
+	street := m.maskValue(m.fields["address.street"], "1 Main St")
+	var tests = []struct {
+		enc  *bqEncoder
+		want string
+	}{
+		{nil, `[{"address":[{"city":"London","street":"` + street + `"}],"email":"` + email + `","id":1,"phone":"***1234"}]`},
+		{&bqEncoder{}, `[{"id":1,"email":"` + email + `","phone":"***1234","address":[{"street":"` + street + `","city":"London"}]}]`},
+		{&bqEncoder{jsSafe: true}, `[{"id":"1","email":"` + email + `","phone":"***1234","address":[{"street":"` + street + `","city":"London"}]}]`},
+	}
+	for _, item := range tests {
+		s, r := m.maskRows(schema, rows)
+		bts, err := item.enc.encodeRows(s, r)
+		if err != nil || string(bts) != item.want {
+			t.Errorf("encodeRows(%+v) = %s, %v Want: %s", item.enc, bts, err, item.want)
+		}
+	}
+
+	if h := m.maskValue(m.fields["email"], "ada@example.com"); len(h) != 64 || h == m.maskValue(m.fields["email"], "bob@example.com") {
+		t.Errorf("maskValue(hash) = %q Want: a distinct hex HMAC", h)
+	}
+	if rows[0][1] != "123-45-6789" {
+		t.Errorf("maskRows() modified the rows read from BigQuery")
+	}
+}
+
+func TestMaskRowsCaseInsensitive(t *testing.T) {
+	rules := []maskRule{{Route: "bq/p/crm/*", Fields: []string{"SSN", "Address.City"}, Action: "drop"}}
+	m, err := newMasker(rules, "/bq/p/crm/customers", principal{})
+	if err != nil {
+		t.Fatalf("newMasker() error: %v", err)
+	}
+
+	// BigQuery column names match the rules whatever their case.
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "ssn", Type: bigquery.StringFieldType},
+		{Name: "ADDRESS", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "street", Type: bigquery.StringFieldType},
+			{Name: "city", Type: bigquery.StringFieldType},
+		}},
+	}
+	rows := [][]bigquery.Value{{int64(1), "123-45-6789", []bigquery.Value{"1 Main St", "London"}}}
+	s, r := m.maskRows(schema, rows)
+	bts, err := (&bqEncoder{}).encodeRows(s, r)
+	if want := `[{"id":1,"ADDRESS":{"street":"1 Main St"}}]`; err != nil || string(bts) != want {
+		t.Errorf("maskRows(case-insensitive) = %s, %v Want: %s", bts, err, want)
+	}
+
+	// Firestore field names are case-sensitive.
+	doc := m.maskDoc("", map[string]interface{}{"ssn": "123-45-6789", "SSN": "987-65-4321"})
+	if _, ok := doc["ssn"]; !ok || doc["SSN"] != nil {
+		t.Errorf("maskDoc() = %v Want: only SSN dropped", doc)
+	}
+}
+
+func TestMaskDoc(t *testing.T) {
+	m, err := newMasker([]maskRule{
+		{Route: "fs/p/customers", Fields: []string{"email", "contacts.phone"}, Action: "partial", Keep: 2},
+		{Route: "fs/p/customers", Fields: []string{"notes"}, Action: "drop"},
+	}, "/fs/p/customers/c1", principal{})
+	if err != nil {
+		t.Fatalf("newMasker() error: %v", err)
+	}
+
+	have := m.maskDoc("", map[string]interface{}{
+		"name":     "Ada",
+		"email":    "ada@ex.io",
+		"notes":    "private",
+		"contacts": []interface{}{map[string]interface{}{"phone": "5551234", "kind": "home"}},
+	})
+	want := map[string]interface{}{
+		"name":     "Ada",
+		"email":    "*******io",
+		"contacts": []interface{}{map[string]interface{}{"phone": "*****34", "kind": "home"}},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("maskDoc() = %v Want: %v", have, want)
+	}
+}
+
+func TestMaskedCacheKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/bq/p/crm/customers", nil)
+	p, err := parseDDURL(req)
+	if err != nil {
+		t.Fatalf("parseDDURL() error: %v", err)
+	}
+	cfg := &cacheConfig{DefaultTTL: duration(60e9)}
+	plain, _ := cachePolicy(req, p, cfg)
+
+	p.mask, err = newMasker(testMaskRules[:1], req.URL.Path, principal{})
+	if err != nil {
+		t.Fatalf("newMasker() error: %v", err)
+	}
+	masked, _ := cachePolicy(req, p, cfg)
+	if masked == plain || masked != "/bq/p/crm/customers#mask=ssn:drop:0" {
+		t.Errorf("cachePolicy(masked) = %q Want: a key apart from %q", masked, plain)
+	}
+
+	if err := p.mask.exportError(&exportTarget{}); errorStatus(err) != 403 {
+		t.Errorf("exportError() = %v Want: status 403", err)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsPath is the path of the Prometheus metrics.
+const metricsPath = "/metrics"
+
+// noLabel is the platform and route label of requests that are not for a data platform path.
+const noLabel = "none"
+
+// otherLabel is the route label of the paths that match no configured route.
+const otherLabel = "other"
+
+var (
+	// metricsRegistry holds the metrics served at /metrics.
+	metricsRegistry = prometheus.NewRegistry()
+
+	requestsTotal = newCounterVec("datadrive_requests_total",
+		"Requests served, by platform, route and status.", "platform", "route", "status")
+	requestSeconds = newHistogramVec("datadrive_request_duration_seconds",
+		"Request latency in seconds, by platform, route and status.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}, "platform", "route", "status")
+	responseBytes = newHistogramVec("datadrive_response_size_bytes",
+		"Response body size in bytes, by platform, route and status.",
+		[]float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}, "platform", "route", "status")
+	bqBytesProcessed = newCounterVec("datadrive_bigquery_bytes_processed_total",
+		"Bytes processed by BigQuery queries, by route.", "route")
+	bqSlotMillis = newCounterVec("datadrive_bigquery_slot_milliseconds_total",
+		"Slot milliseconds consumed by BigQuery queries, by route.", "route")
+	fsDocumentsRead = newCounterVec("datadrive_firestore_documents_read_total",
+		"Firestore documents read, by route.", "route")
+	cacheRequests = newCounterVec("datadrive_cache_requests_total",
+		"Response cache lookups, by route and result (hit or miss).", "route", "result")
+	clientsCreated = newCounterVec("datadrive_clients_created_total",
+		"Data platform clients created, by client.", "client")
+)
+
+// newCounter registers a counter without labels.
+func newCounter(name, help string) prometheus.Counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+	metricsRegistry.MustRegister(c)
+	return c
+}
+
+// newCounterVec registers a counter with labels.
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	c := prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+	metricsRegistry.MustRegister(c)
+	return c
+}
+
+// newHistogramVec registers a histogram with labels.
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	h := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	metricsRegistry.MustRegister(h)
+	return h
+}
+
+// metricsHandler writes the registered metrics in the Prometheus exposition format.
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// serveMetrics handles GET /metrics.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, fmt.Sprintf("method %s is not supported for this path", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	metricsHandler.ServeHTTP(w, r)
+}
+
+// requestLabels are the platform and route labels of a request. They are set once the path has been parsed.
+type requestLabels struct {
+	mu       sync.Mutex
+	platform string
+	route    string
+}
+
+// requestLabelsKey is the context key of the labels of the request.
+type requestLabelsKey struct{}
+
+// withRequestLabels returns a copy of ctx carrying empty labels.
+func withRequestLabels(ctx context.Context) (context.Context, *requestLabels) {
+	l := &requestLabels{platform: noLabel, route: noLabel}
+	return context.WithValue(ctx, requestLabelsKey{}, l), l
+}
+
+// set labels the request with the data platform and route of the path.
+func (l *requestLabels) set(p *dataConnParam, cfg *config) {
+	l.mu.Lock()
+	l.platform, l.route = p.platform, metricRoute(p, cfg)
+	l.mu.Unlock()
+}
+
+// get returns the platform and route labels.
+func (l *requestLabels) get() (string, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.platform, l.route
+}
+
+// contextRoute returns the route label of the request of ctx.
+func contextRoute(ctx context.Context) string {
+	if l, ok := ctx.Value(requestLabelsKey{}).(*requestLabels); ok {
+		_, route := l.get()
+		return route
+	}
+	return noLabel
+}
+
+// metricRoute returns the route label of the path: the name of the first metrics route matching it, the name of a
+// configured saved query, or "other". Only configured names are used so that the number of series stays bounded
+// whatever paths are requested.
+func metricRoute(p *dataConnParam, cfg *config) string {
+	path := drivePath(p.platform, p.connectionParams...)
+	for _, r := range cfg.Metrics.Routes {
+		if routeMatches(r.Route, path) {
+			return r.Name
+		}
+	}
+	if p.platform == "q" && len(p.connectionParams) == 1 {
+		if _, ok := cfg.query(p.connectionParams[0]); ok {
+			return "q/" + p.connectionParams[0]
+		}
+	}
+	return otherLabel
+}
+
+// metricsWriter records the status and size of a response.
+type metricsWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// status returns the status code of the response.
+func (w *metricsWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// observeRequest records the count, latency and response size of a finished request.
+func observeRequest(l *requestLabels, w *metricsWriter, seconds float64) {
+	platform, route := l.get()
+	status := strconv.Itoa(w.status())
+	requestsTotal.WithLabelValues(platform, route, status).Inc()
+	requestSeconds.WithLabelValues(platform, route, status).Observe(seconds)
+	responseBytes.WithLabelValues(platform, route, status).Observe(float64(w.bytes))
+}
+
+// observeBQJob records the bytes processed and the slot time of a finished BigQuery job.
+func observeBQJob(ctx context.Context, st *bigquery.JobStatus) {
+	if st == nil || st.Statistics == nil {
+		return
+	}
+	route := contextRoute(ctx)
+	bqBytesProcessed.WithLabelValues(route).Add(float64(st.Statistics.TotalBytesProcessed))
+	if qs, ok := st.Statistics.Details.(*bigquery.QueryStatistics); ok {
+		bqSlotMillis.WithLabelValues(route).Add(float64(qs.SlotMillis))
+	}
+}
+
+// observeFSReads records Firestore document reads.
+func observeFSReads(ctx context.Context, n int) {
+	fsDocumentsRead.WithLabelValues(contextRoute(ctx)).Add(float64(n))
+}
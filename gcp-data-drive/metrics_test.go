@@ -0,0 +1,79 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricRoute(t *testing.T) {
+	cfg := &config{
+		Metrics: metricsConfig{Routes: []metricsRoute{
+			{Route: "/bq/p/d/v/_jobs", Name: "jobs"},
+			{Route: "/bq/p/d/v", Name: "sales"},
+			{Route: "/fs/p/orders", Name: "orders"},
+		}},
+		Queries: []savedQuery{{Name: "top"}},
+	}
+
+	var tests = []struct {
+		in   string
+		want string
+	}{
+		{"/bq/p/d/v", "sales"},
+		{"/bq/p/d/v/_jobs/job_123/results", "jobs"},
+		{"/fs/p/orders/o1/items/i2", "orders"},
+		{"/bq/p/d/random_1234", "other"},
+		{"/fs/p/customers/c1", "other"},
+		{"/q/top", "q/top"},
+		{"/q/unknown", "other"},
+	}
+
+	for _, item := range tests {
+		p, err := parseDDURL(httptest.NewRequest("GET", item.in, nil))
+		if err != nil {
+			t.Fatalf("parseDDURL(%s) error: %v", item.in, err)
+		}
+		if have := metricRoute(p, cfg); have != item.want {
+			t.Errorf("metricRoute(%s) = %q Want: %q", item.in, have, item.want)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	setConfig(&config{})
+
+	// A request for an unknown platform is counted with its status.
+	GetJSONData(httptest.NewRecorder(), httptest.NewRequest("GET", "/xx/p/d/v", nil))
+
+	w := httptest.NewRecorder()
+	GetJSONData(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`# TYPE datadrive_requests_total counter`,
+		`datadrive_requests_total{platform="none",route="none",status="500"} `,
+		`datadrive_request_duration_seconds_bucket{platform="none",route="none",status="500",le="+Inf"} `,
+		`# TYPE datadrive_request_duration_seconds histogram`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET /metrics does not contain %q:\n%s", want, body)
+		}
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("GET /metrics Content-Type = %q Want: the Prometheus text format", ct)
+	}
+}
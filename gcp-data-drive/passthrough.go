@@ -0,0 +1,98 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// accessToken returns the OAuth access token of the caller when credential passthrough is enabled. Requests without
+// a token are rejected with 401 Unauthorized when passthrough is required and run as the service account otherwise.
+func accessToken(r *http.Request, cfg *passthroughConfig) (string, error) {
+	if !cfg.Enabled {
+		return "", nil
+	}
+
+	var token string
+	if cfg.Header == "" {
+		h := r.Header.Get("Authorization")
+		if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+			token = strings.TrimSpace(h[7:])
+		}
+	} else {
+		token = strings.TrimSpace(strings.TrimPrefix(r.Header.Get(cfg.Header), "Bearer "))
+	}
+
+	if token == "" && cfg.Required {
+		return "", &statusError{http.StatusUnauthorized, errors.New("an OAuth access token of the caller is required")}
+	}
+	return token, nil
+}
+
+// clientOptions returns the options of the BigQuery and Firestore clients of the request. Requests carrying the
+// access token of the caller use it, and paths matching an impersonation route use the tokens of its service
+// account, instead of the credentials of the service.
+func (p *dataConnParam) clientOptions() ([]option.ClientOption, error) {
+	if p.token != "" {
+		return []option.ClientOption{option.WithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: p.token}))}, nil
+	}
+
+	cfg, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	r := cfg.impersonation(drivePath(p.platform, p.connectionParams...))
+	if r == nil {
+		return nil, nil
+	}
+	ts, err := impersonatedTokenSource(r)
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithTokenSource(ts)}, nil
+}
+
+// tokenError returns err with a 401 Unauthorized or 403 Forbidden status when BigQuery or Firestore rejected the
+// access token of the caller. Errors of requests that run as the service account are returned unchanged.
+func (p *dataConnParam) tokenError(err error) error {
+	if p.token == "" || err == nil || errorStatus(err) != http.StatusInternalServerError {
+		return err
+	}
+
+	var ge *googleapi.Error
+	if errors.As(err, &ge) && (ge.Code == http.StatusUnauthorized || ge.Code == http.StatusForbidden) {
+		return &statusError{ge.Code, err}
+	}
+	var be *bigquery.Error
+	if errors.As(err, &be) && be.Reason == "accessDenied" {
+		return &statusError{http.StatusForbidden, err}
+	}
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		return &statusError{http.StatusUnauthorized, err}
+	case codes.PermissionDenied:
+		return &statusError{http.StatusForbidden, err}
+	}
+	return err
+}
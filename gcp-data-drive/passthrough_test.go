@@ -0,0 +1,111 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAccessToken(t *testing.T) {
+	var tests = []struct {
+		cfg    passthroughConfig
+		header string
+		value  string
+		want   string
+		code   int
+	}{
+		{passthroughConfig{}, "Authorization", "Bearer ya29.token", "", 0},
+		{passthroughConfig{Enabled: true}, "Authorization", "Bearer ya29.token", "ya29.token", 0},
+		{passthroughConfig{Enabled: true}, "", "", "", 0},
+		{passthroughConfig{Enabled: true, Required: true}, "", "", "", http.StatusUnauthorized},
+		{passthroughConfig{Enabled: true, Header: "X-Access-Token"}, "X-Access-Token", "ya29.token", "ya29.token", 0},
+		{passthroughConfig{Enabled: true, Header: "X-Access-Token", Required: true}, "Authorization", "Bearer id.token", "", http.StatusUnauthorized},
+	}
+
+	for _, item := range tests {
+		req := httptest.NewRequest("GET", "/bq/p/d/v", nil)
+		if item.header != "" {
+			req.Header.Set(item.header, item.value)
+		}
+		have, err := accessToken(req, &item.cfg)
+		if item.code != 0 {
+			if errorStatus(err) != item.code {
+				t.Errorf("accessToken(%+v) error = %v Want: status %d", item.cfg, err, item.code)
+			}
+			continue
+		}
+		if err != nil || have != item.want {
+			t.Errorf("accessToken(%+v) = %q, %v Want: %q", item.cfg, have, err, item.want)
+		}
+	}
+}
+
+func TestTokenError(t *testing.T) {
+	var tests = []struct {
+		in   error
+		want int
+	}{
+		{&googleapi.Error{Code: 401}, http.StatusUnauthorized},
+		{&googleapi.Error{Code: 403}, http.StatusForbidden},
+		{fmt.Errorf("reading: %w", &googleapi.Error{Code: 403}), http.StatusForbidden},
+		{&bigquery.Error{Reason: "accessDenied"}, http.StatusForbidden},
+		{status.Error(codes.PermissionDenied, "denied"), http.StatusForbidden},
+		{status.Error(codes.Unauthenticated, "expired"), http.StatusUnauthorized},
+		{&statusError{http.StatusBadRequest, errors.New("bad")}, http.StatusBadRequest},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+
+	p := &dataConnParam{token: "ya29.token"}
+	for _, item := range tests {
+		if have := errorStatus(p.tokenError(item.in)); have != item.want {
+			t.Errorf("tokenError(%v) = %d Want: %d", item.in, have, item.want)
+		}
+	}
+
+	p.token = ""
+	if have := errorStatus(p.tokenError(&googleapi.Error{Code: 403})); have != http.StatusInternalServerError {
+		t.Errorf("tokenError(service account) = %d Want: %d", have, http.StatusInternalServerError)
+	}
+}
+
+func TestPassthroughNotCached(t *testing.T) {
+	cfg := &cacheConfig{DefaultTTL: duration(time.Minute)}
+	req := httptest.NewRequest("GET", "/bq/p/d/v", nil)
+	p, err := parseDDURL(req)
+	if err != nil {
+		t.Fatalf("parseDDURL() error: %v", err)
+	}
+	if key, ttl := cachePolicy(req, p, cfg); key == "" || ttl == 0 {
+		t.Errorf("cachePolicy() = %q, %v Want: a cached read", key, ttl)
+	}
+
+	p.token = "ya29.token"
+	if key, ttl := cachePolicy(req, p, cfg); key != "" || ttl != 0 {
+		t.Errorf("cachePolicy(passthrough) = %q, %v Want: not cached", key, ttl)
+	}
+	if copts, err := p.clientOptions(); err != nil || len(copts) != 1 {
+		t.Errorf("clientOptions() = %v, %v Want: the token source of the caller", copts, err)
+	}
+}
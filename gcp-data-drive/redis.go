@@ -0,0 +1,202 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// defaultRedisKeyPrefix namespaces the keys when cache.redis.keyPrefix is not configured.
+	defaultRedisKeyPrefix = "gcpdatadrive:"
+
+	// defaultCompressAbove is the encoded size in bytes above which entries are compressed when
+	// cache.redis.compressAbove is not configured.
+	defaultCompressAbove = 1024
+
+	// The first byte of a stored value tells whether the rest is gzip compressed.
+	redisRaw  byte = 'r'
+	redisGzip byte = 'z'
+)
+
+// redisEntry is the encoded form of a cacheEntry in Redis.
+type redisEntry struct {
+	Body   []byte
+	Header http.Header
+	ETag   string
+}
+
+// redisStore is a response store shared by every instance of the deployment, such as a Memorystore for Redis
+// instance. Redis expires the keys so entries are stored with their TTL.
+type redisStore struct {
+	client    redis.UniversalClient
+	keyPrefix string
+
+	// compressAbove is the encoded size above which entries are gzip compressed. Negative disables compression.
+	compressAbove int
+
+	// maxBytes limits the size of the stored values after compression. Zero means no limit.
+	maxBytes int
+}
+
+// newRedisStore returns the Redis store described by the configuration.
+func newRedisStore(cfg *redisConfig, maxBytes int) *redisStore {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	return newRedisStoreWithClient(client, cfg, maxBytes)
+}
+
+// newRedisStoreWithClient returns a Redis store that uses client.
+func newRedisStoreWithClient(client redis.UniversalClient, cfg *redisConfig, maxBytes int) *redisStore {
+	s := &redisStore{
+		client:        client,
+		keyPrefix:     cfg.KeyPrefix,
+		compressAbove: cfg.CompressAbove,
+		maxBytes:      maxBytes,
+	}
+	if s.keyPrefix == "" {
+		s.keyPrefix = defaultRedisKeyPrefix
+	}
+	if s.compressAbove == 0 {
+		s.compressAbove = defaultCompressAbove
+	}
+	return s
+}
+
+// load returns the entry for key or nil when Redis does not hold it.
+func (s *redisStore) load(ctx context.Context, key string) (*cacheEntry, error) {
+	v, err := s.client.Get(ctx, s.keyPrefix+key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	re, err := decodeRedisEntry(v)
+	if err != nil {
+		return nil, fmt.Errorf("decoding cached %s: %v", key, err)
+	}
+	return &cacheEntry{body: re.Body, header: re.Header, etag: re.ETag}, nil
+}
+
+// store encodes the entry and sets it with the TTL.
+func (s *redisStore) store(ctx context.Context, key string, e *cacheEntry, ttl time.Duration) error {
+	v, err := s.encode(e)
+	if err != nil {
+		return err
+	}
+	if s.maxBytes > 0 && len(v) > s.maxBytes {
+		return nil
+	}
+	return s.client.Set(ctx, s.keyPrefix+key, v, ttl).Err()
+}
+
+// invalidate deletes the keys below prefix. The keys are found with SCAN so Redis is not blocked.
+func (s *redisStore) invalidate(ctx context.Context, prefix string) error {
+	match := s.keyPrefix + escapeRedisPattern(strings.TrimSuffix(prefix, "/")) + "*"
+	it := s.client.Scan(ctx, 0, match, 100).Iterator()
+	var keys []string
+	for it.Next(ctx) {
+		// The pattern also matches sibling paths such as /fs/p/events2 for /fs/p/events.
+		if keyUnder(strings.TrimPrefix(it.Val(), s.keyPrefix), prefix) {
+			keys = append(keys, it.Val())
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.client.Del(ctx, keys...).Err()
+}
+
+// encode returns the stored value of the entry, compressed when it is larger than compressAbove.
+func (s *redisStore) encode(e *cacheEntry) ([]byte, error) {
+	var raw bytes.Buffer
+	raw.WriteByte(redisRaw)
+	if err := gob.NewEncoder(&raw).Encode(&redisEntry{Body: e.body, Header: e.header, ETag: e.etag}); err != nil {
+		return nil, err
+	}
+	if s.compressAbove < 0 || raw.Len() <= s.compressAbove {
+		return raw.Bytes(), nil
+	}
+
+	var z bytes.Buffer
+	z.WriteByte(redisGzip)
+	zw := gzip.NewWriter(&z)
+	if _, err := zw.Write(raw.Bytes()[1:]); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return z.Bytes(), nil
+}
+
+// decodeRedisEntry decodes a stored value.
+func decodeRedisEntry(v []byte) (*redisEntry, error) {
+	if len(v) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+
+	data := v[1:]
+	switch v[0] {
+	case redisRaw:
+	case redisGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", v[0])
+	}
+
+	re := &redisEntry{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(re); err != nil {
+		return nil, err
+	}
+	return re, nil
+}
+
+// escapeRedisPattern escapes the glob characters of s for a SCAN MATCH pattern.
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
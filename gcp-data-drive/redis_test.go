@@ -0,0 +1,113 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package gcpdatadrive
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisStore returns a Redis store backed by an in-process Redis server.
+func newTestRedisStore(t *testing.T, cfg *redisConfig, maxBytes int) (*redisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	cfg.Addr = mr.Addr()
+	s := newRedisStore(cfg, maxBytes)
+	t.Cleanup(func() { s.client.Close() })
+	return s, mr
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisStore(t, &redisConfig{CompressAbove: 512}, 0)
+
+	var tests = []struct {
+		key  string
+		body []byte
+		want byte
+	}{
+		{"/bq/p/d/small", []byte(`[{"n":1}]`), redisRaw},
+		{"/bq/p/d/large?types=strict", bytes.Repeat([]byte(`{"name":"value"},`), 100), redisGzip},
+	}
+
+	for _, item := range tests {
+		e := newCacheEntry(item.body, http.Header{"X-Document-Path": {"a/b"}})
+		if err := s.store(ctx, item.key, e, time.Minute); err != nil {
+			t.Fatalf("store(%q) error: %v", item.key, err)
+		}
+
+		raw, err := mr.Get("gcpdatadrive:" + item.key)
+		if err != nil {
+			t.Fatalf("Redis GET %q error: %v", item.key, err)
+		}
+		if raw[0] != item.want {
+			t.Errorf("stored %q encoding = %q Want: %q", item.key, raw[0], item.want)
+		}
+
+		have, err := s.load(ctx, item.key)
+		if err != nil {
+			t.Fatalf("load(%q) error: %v", item.key, err)
+		}
+		if have == nil || !bytes.Equal(have.body, e.body) || have.etag != e.etag || !reflect.DeepEqual(have.header, e.header) {
+			t.Errorf("load(%q) = %+v Want: %+v", item.key, have, e)
+		}
+	}
+
+	// Redis expires the entries with their TTL.
+	mr.FastForward(2 * time.Minute)
+	if e, err := s.load(ctx, "/bq/p/d/small"); e != nil || err != nil {
+		t.Errorf("load() after the TTL = %v, %v Want: nil, nil", e, err)
+	}
+}
+
+func TestRedisStoreLimits(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisStore(t, &redisConfig{KeyPrefix: "dd:", CompressAbove: -1}, 128)
+
+	if err := s.store(ctx, "/fs/p/big", newCacheEntry(bytes.Repeat([]byte("x"), 256), nil), time.Minute); err != nil {
+		t.Fatalf("store() error: %v", err)
+	}
+	if mr.Exists("dd:/fs/p/big") {
+		t.Errorf("store() of an entry over the limit set the key Want: not stored")
+	}
+}
+
+func TestRedisStoreInvalidate(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisStore(t, &redisConfig{}, 0)
+
+	keys := []string{"/fs/p/events", "/fs/p/events/a?meta=body", "/fs/p/events2", "/fs/p/ev[1]"}
+	for _, k := range keys {
+		if err := s.store(ctx, k, newCacheEntry([]byte("{}"), nil), time.Minute); err != nil {
+			t.Fatalf("store(%q) error: %v", k, err)
+		}
+	}
+
+	if err := s.invalidate(ctx, "/fs/p/events"); err != nil {
+		t.Fatalf("invalidate() error: %v", err)
+	}
+	if err := s.invalidate(ctx, "/fs/p/ev[1]"); err != nil {
+		t.Fatalf("invalidate() error: %v", err)
+	}
+	for k, want := range map[string]bool{"/fs/p/events": false, "/fs/p/events/a?meta=body": false, "/fs/p/events2": true, "/fs/p/ev[1]": false} {
+		if have := mr.Exists("gcpdatadrive:" + k); have != want {
+			t.Errorf("key %q exists after invalidate = %v Want: %v", k, have, want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	// rowFilterParam prefixes the names of the query parameters holding the filter values.
+	rowFilterParam = "drive_row_filter_"
+
+	// maxFSInValues is the number of values a Firestore in filter accepts.
+	maxFSInValues = 30
+)
+
+// bqColumnRE matches the dotted BigQuery column names that row filters may use.
+var bqColumnRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// boundFilter is a row filter bound to the claim value of the caller.
+type boundFilter struct {
+	field string
+
+	// value is a string, int64, float64 or bool, or a []interface{} of them for array claims.
+	value interface{}
+}
+
+// bindRowFilters binds the row filters of the routes matching the path to the claims of the caller. Callers without
+// the claims, including anonymous callers, are rejected with 403 Forbidden so the filters can not be avoided.
+func bindRowFilters(filters []rowFilter, path string, id *identity) ([]boundFilter, error) {
+	var res []boundFilter
+	for _, f := range filters {
+		if !routeMatches(f.Route, path) {
+			continue
+		}
+		var claim interface{}
+		if id != nil {
+			claim = id.Claims[f.Claim]
+		}
+		if claim == nil {
+			return nil, &statusError{http.StatusForbidden, fmt.Errorf("%s requires the %s claim", path, f.Claim)}
+		}
+		v, err := filterValue(claim)
+		if err != nil {
+			return nil, &statusError{http.StatusForbidden, fmt.Errorf("claim %s: %v", f.Claim, err)}
+		}
+		res = append(res, boundFilter{field: f.Field, value: v})
+	}
+	return res, nil
+}
+
+// filterValue converts a JSON claim value. Integral numbers become int64.
+func filterValue(claim interface{}) (interface{}, error) {
+	switch t := claim.(type) {
+	case string, bool:
+		return t, nil
+
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1<<53 {
+			return int64(t), nil
+		}
+		return t, nil
+
+	case []interface{}:
+		if len(t) == 0 {
+			return nil, errors.New("the array has no values")
+		}
+		vs := make([]interface{}, len(t))
+		for i, item := range t {
+			v, err := filterValue(item)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := v.([]interface{}); ok {
+				return nil, errors.New("nested arrays are not supported")
+			}
+			if i > 0 && reflect.TypeOf(v) != reflect.TypeOf(vs[0]) {
+				return nil, errors.New("the values of an array claim must have the same type")
+			}
+			vs[i] = v
+		}
+		return vs, nil
+	}
+	return nil, fmt.Errorf("unsupported claim value %T", claim)
+}
+
+// rowFilterKey identifies the bound values so that the cached results of different callers are kept apart.
+func rowFilterKey(filters []boundFilter) string {
+	vals := url.Values{}
+	for _, f := range filters {
+		vals.Add(f.field, fmt.Sprint(f.value))
+	}
+	return vals.Encode()
+}
+
+// filterBQQuery wraps the query so it only returns the rows matching the filters. The values are given as query
+// parameters so they can not change the query text.
+func filterBQQuery(q *bigquery.Query, filters []boundFilter) error {
+	if len(filters) == 0 {
+		return nil
+	}
+	conds := make([]string, len(filters))
+	for i, f := range filters {
+		if !bqColumnRE.MatchString(f.field) {
+			return fmt.Errorf("rowFilters: %q is not a column name", f.field)
+		}
+		col := "`" + strings.Join(strings.Split(f.field, "."), "`.`") + "`"
+		name := rowFilterParam + strconv.Itoa(i)
+
+		if vs, ok := f.value.([]interface{}); ok {
+			conds[i] = fmt.Sprintf("%s in unnest(@%s)", col, name)
+			q.Parameters = append(q.Parameters, bigquery.QueryParameter{Name: name, Value: bqArrayParam(vs)})
+			continue
+		}
+		conds[i] = fmt.Sprintf("%s = @%s", col, name)
+		q.Parameters = append(q.Parameters, bigquery.QueryParameter{Name: name, Value: f.value})
+	}
+	q.Q = fmt.Sprintf("select * from (%s) where %s", q.Q, strings.Join(conds, " and "))
+	return nil
+}
+
+// bqArrayParam returns the typed slice of an array claim so BigQuery infers the element type.
+func bqArrayParam(vs []interface{}) interface{} {
+	res := reflect.MakeSlice(reflect.SliceOf(reflect.TypeOf(vs[0])), len(vs), len(vs))
+	for i, v := range vs {
+		res.Index(i).Set(reflect.ValueOf(v))
+	}
+	return res.Interface()
+}
+
+// rowFilterParamsMatch reports whether the row filter parameters of a job are the ones bound for the caller, so
+// callers can not read the jobs of others by their id.
+func rowFilterParamsMatch(job, want []bigquery.QueryParameter) bool {
+	filterParams := func(params []bigquery.QueryParameter) map[string]string {
+		m := map[string]string{}
+		for _, p := range params {
+			if strings.HasPrefix(p.Name, rowFilterParam) {
+				m[p.Name] = fmt.Sprint(p.Value)
+			}
+		}
+		return m
+	}
+	return reflect.DeepEqual(filterParams(job), filterParams(want))
+}
+
+// filterFSQuery restricts the query to the documents matching the filters.
+func filterFSQuery(q firestore.Query, filters []boundFilter) (firestore.Query, error) {
+	for _, f := range filters {
+		if vs, ok := f.value.([]interface{}); ok {
+			if len(vs) > maxFSInValues {
+				return q, &statusError{http.StatusForbidden, fmt.Errorf("the %s filter has more than %d values", f.field, maxFSInValues)}
+			}
+			q = q.Where(f.field, "in", vs)
+			continue
+		}
+		q = q.Where(f.field, "==", f.value)
+	}
+	return q, nil
+}
+
+// filtersAllow reports whether the document data matches the filters. Dotted fields name nested map fields, as
+// they do in the queries.
+func filtersAllow(filters []boundFilter, data map[string]interface{}) bool {
+	for _, f := range filters {
+		v, ok := fsField(data, f.field)
+		if !ok || !filterAllows(f, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// fsField returns the value of the dotted field of the document data.
+func fsField(data map[string]interface{}, field string) (interface{}, bool) {
+	names := strings.Split(field, ".")
+	for _, name := range names[:len(names)-1] {
+		m, ok := data[name].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		data = m
+	}
+	v, ok := data[names[len(names)-1]]
+	return v, ok
+}
+
+// setFSField sets the dotted field of the document data, replacing the values on its path that are not maps.
+func setFSField(data map[string]interface{}, field string, v interface{}) {
+	names := strings.Split(field, ".")
+	for _, name := range names[:len(names)-1] {
+		m, ok := data[name].(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{}
+			data[name] = m
+		}
+		data = m
+	}
+	data[names[len(names)-1]] = v
+}
+
+// filterAllows reports whether the value is the bound value, or one of the bound values of an array claim.
+func filterAllows(f boundFilter, v interface{}) bool {
+	vs, ok := f.value.([]interface{})
+	if !ok {
+		vs = []interface{}{f.value}
+	}
+	for _, want := range vs {
+		if filterEqual(want, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterEqual compares a bound value with a document value. Numbers compare equal across integer and double types
+// as they do in Firestore queries.
+func filterEqual(want, v interface{}) bool {
+	toFloat := func(x interface{}) (float64, bool) {
+		switch t := x.(type) {
+		case int64:
+			return float64(t), true
+		case float64:
+			return t, true
+		}
+		return 0, false
+	}
+	if a, ok := toFloat(want); ok {
+		b, ok := toFloat(v)
+		return ok && a == b
+	}
+	return want == v
+}
+
+// filterFSWrite makes a document written through a filtered path match the filters. Single valued filters set the
+// field, and the field of a document written with an array claim must be one of its values.
+func filterFSWrite(filters []boundFilter, data map[string]interface{}) error {
+	for _, f := range filters {
+		if _, ok := f.value.([]interface{}); !ok {
+			setFSField(data, f.field, f.value)
+			continue
+		}
+		if v, ok := fsField(data, f.field); !ok || !filterAllows(f, v) {
+			return &statusError{http.StatusForbidden, fmt.Errorf("the %s field must be one of the values of the caller", f.field)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+var testRowFilters = []rowFilter{
+	{Route: "bq/p/shared/*", Field: "tenant_id", Claim: "tenant"},
+	{Route: "fs/p/orders", Field: "region", Claim: "regions"},
+}
+
+func TestBindRowFilters(t *testing.T) {
+	var tests = []struct {
+		path   string
+		claims map[string]interface{}
+		want   []boundFilter
+		code   int
+	}{
+		{"/bq/p/shared/sales", map[string]interface{}{"tenant": "acme"}, []boundFilter{{"tenant_id", "acme"}}, 0},
+		{"/bq/p/shared/sales", map[string]interface{}{"tenant": float64(42)}, []boundFilter{{"tenant_id", int64(42)}}, 0},
+		{"/fs/p/orders/o1", map[string]interface{}{"regions": []interface{}{"eu", "us"}}, []boundFilter{{"region", []interface{}{"eu", "us"}}}, 0},
+		{"/bq/p/private/sales", nil, nil, 0},
+		{"/bq/p/shared/sales", nil, nil, http.StatusForbidden},
+		{"/bq/p/shared/sales", map[string]interface{}{"email": "a@example.com"}, nil, http.StatusForbidden},
+		{"/fs/p/orders", map[string]interface{}{"regions": []interface{}{"eu", float64(1)}}, nil, http.StatusForbidden},
+		{"/fs/p/orders", map[string]interface{}{"regions": []interface{}{}}, nil, http.StatusForbidden},
+	}
+
+	for _, item := range tests {
+		var id *identity
+		if item.claims != nil {
+			id = &identity{Subject: "s", Claims: item.claims}
+		}
+		have, err := bindRowFilters(testRowFilters, item.path, id)
+		if item.code != 0 {
+			if errorStatus(err) != item.code {
+				t.Errorf("bindRowFilters(%s, %v) error = %v Want: status %d", item.path, item.claims, err, item.code)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(have, item.want) {
+			t.Errorf("bindRowFilters(%s, %v) = %v, %v Want: %v", item.path, item.claims, have, err, item.want)
+		}
+	}
+}
+
+func TestFilterBQQuery(t *testing.T) {
+	q := &bigquery.Query{QueryConfig: bigquery.QueryConfig{Q: "select * from `p.shared.sales`"}}
+	err := filterBQQuery(q, []boundFilter{{"tenant_id", "acme"}, {"org.region", []interface{}{"eu", "us"}}})
+	if err != nil {
+		t.Fatalf("filterBQQuery() error: %v", err)
+	}
+
+	want := "select * from (select * from `p.shared.sales`) where `tenant_id` = @drive_row_filter_0 and `org`.`region` in unnest(@drive_row_filter_1)"
+	if q.Q != want {
+		t.Errorf("filterBQQuery() = %q Want: %q", q.Q, want)
+	}
+	params := []bigquery.QueryParameter{{Name: "drive_row_filter_0", Value: "acme"}, {Name: "drive_row_filter_1", Value: []string{"eu", "us"}}}
+	if !reflect.DeepEqual(q.Parameters, params) {
+		t.Errorf("filterBQQuery() parameters = %v Want: %v", q.Parameters, params)
+	}
+
+	// The jobs of another tenant are not found by their id.
+	other := []bigquery.QueryParameter{{Name: "drive_row_filter_0", Value: "globex"}, params[1]}
+	if rowFilterParamsMatch(other, q.Parameters) || !rowFilterParamsMatch(params, q.Parameters) {
+		t.Errorf("rowFilterParamsMatch() does not tell the jobs of tenants apart")
+	}
+
+	if err := filterBQQuery(q, []boundFilter{{"tenant_id; drop", "x"}}); err == nil {
+		t.Errorf("filterBQQuery(invalid column) = nil Want: an error")
+	}
+}
+
+func TestFilterFSDocuments(t *testing.T) {
+	single := []boundFilter{{"tenant", "acme"}}
+	multi := []boundFilter{{"region", []interface{}{"eu", "us"}}, {"level", int64(2)}}
+	nested := []boundFilter{{"owner.tenant", "acme"}}
+
+	var tests = []struct {
+		filters []boundFilter
+		data    map[string]interface{}
+		want    bool
+	}{
+		{single, map[string]interface{}{"tenant": "acme"}, true},
+		{single, map[string]interface{}{"tenant": "globex"}, false},
+		{single, map[string]interface{}{}, false},
+		{multi, map[string]interface{}{"region": "us", "level": float64(2)}, true},
+		{multi, map[string]interface{}{"region": "apac", "level": int64(2)}, false},
+		{nested, map[string]interface{}{"owner": map[string]interface{}{"tenant": "acme"}}, true},
+		{nested, map[string]interface{}{"owner": map[string]interface{}{"tenant": "globex"}}, false},
+		{nested, map[string]interface{}{"owner.tenant": "acme"}, false},
+		{nested, map[string]interface{}{"owner": "acme"}, false},
+	}
+	for _, item := range tests {
+		if have := filtersAllow(item.filters, item.data); have != item.want {
+			t.Errorf("filtersAllow(%v, %v) = %v Want: %v", item.filters, item.data, have, item.want)
+		}
+	}
+
+	// Writes take the value of a single valued filter and must stay within the values of an array claim.
+	data := map[string]interface{}{"tenant": "globex"}
+	if err := filterFSWrite(single, data); err != nil || data["tenant"] != "acme" {
+		t.Errorf("filterFSWrite(single) = %v, %v Want: tenant acme", data, err)
+	}
+	data = map[string]interface{}{"owner": map[string]interface{}{"name": "Ada", "tenant": "globex"}}
+	if err := filterFSWrite(nested, data); err != nil || !filtersAllow(nested, data) || data["owner"].(map[string]interface{})["name"] != "Ada" {
+		t.Errorf("filterFSWrite(nested) = %v, %v Want: owner.tenant acme", data, err)
+	}
+	if err := filterFSWrite(multi, map[string]interface{}{"region": "apac"}); errorStatus(err) != http.StatusForbidden {
+		t.Errorf("filterFSWrite(outside) error = %v Want: status %d", err, http.StatusForbidden)
+	}
+}
+
+func TestRowFilterCacheKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/bq/p/shared/sales", nil)
+	p, err := parseDDURL(req)
+	if err != nil {
+		t.Fatalf("parseDDURL() error: %v", err)
+	}
+	cfg := &cacheConfig{DefaultTTL: duration(60e9)}
+
+	p.filters = []boundFilter{{"tenant_id", "acme"}}
+	acme, _ := cachePolicy(req, p, cfg)
+	p.filters = []boundFilter{{"tenant_id", "globex"}}
+	globex, _ := cachePolicy(req, p, cfg)
+	if acme == globex || acme != "/bq/p/shared/sales#filter=tenant_id=acme" {
+		t.Errorf("cachePolicy() = %q, %q Want: a key per tenant", acme, globex)
+	}
+}
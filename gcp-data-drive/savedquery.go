@@ -0,0 +1,254 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+// timestampParamFormat is the layout of TIMESTAMP query parameter values.
+const timestampParamFormat = "2006-01-02 15:04:05.999999-07:00"
+
+// newSavedQueryPlatform returns the bqDataPlatform that runs the saved query named by the /q/{name} path with the
+// parameters of the request URL. The results go through the same encoders, exports and byte limits as a view.
+func newSavedQueryPlatform(ctx context.Context, p *dataConnParam) (dataPlatform, error) {
+	if len(p.connectionParams) != 1 || p.connectionParams[0] == "" {
+		return nil, errors.New("the url path must be in the form https://host/q/name")
+	}
+
+	cfg, err := getConfig()
+	if err != nil {
+		return nil, err
+	}
+	sq, ok := cfg.query(p.connectionParams[0])
+	if !ok {
+		return nil, &statusError{http.StatusNotFound, fmt.Errorf("unknown query %q", p.connectionParams[0])}
+	}
+
+	// Read the declared parameters before any client is created.
+	params, err := savedQueryParams(sq, p.query)
+	if err != nil {
+		return nil, err
+	}
+
+	// Select the job options of the route matching the path.
+	opts, route := cfg.BigQuery.options(drivePath("q", sq.Name))
+	if sq.Project == "" && opts.BillingProject == "" {
+		return nil, fmt.Errorf("query %q has no project and bigquery.billingProject is not set", sq.Name)
+	}
+
+	// Create the BigQuery client with the credentials selected for the request.
+	copts, err := p.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	c, err := newBQClient(ctx, opts, sq.Project, copts...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the parameterized standard SQL query.
+	q := c.Query(sq.SQL)
+	q.UseStandardSQL = true
+	q.Parameters = params
+
+	// Only the rows matching the claims of the caller are returned.
+	if err := filterBQQuery(q, p.filters); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Apply the job options and limit the bytes billed by the query.
+	if err := applyBQOptions(q, opts, route, p.caller); err != nil {
+		c.Close()
+		return nil, err
+	}
+	budget := newBQBudget(q, opts)
+
+	// Select the typed encoder requested with the types and geo query parameters.
+	enc, err := newBQEncoder(p.query)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Select the Cloud Storage export requested with the export and format query parameters.
+	exp, err := newExportTarget(p.query, "json", "csv", "parquet")
+	if err == nil {
+		err = p.mask.exportError(exp)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &bqDataPlatform{
+		dataQuery: sq.SQL,
+		query:     q,
+		client:    c,
+		encoder:   enc,
+		export:    exp,
+		budget:    budget,
+		mask:      p.mask,
+	}, nil
+}
+
+// savedQueryParams reads the declared parameters of the saved query from the url query parameters. Invalid and
+// missing values are rejected with 400 Bad Request.
+func savedQueryParams(sq *savedQuery, query url.Values) ([]bigquery.QueryParameter, error) {
+	params := make([]bigquery.QueryParameter, 0, len(sq.Params))
+	for _, qp := range sq.Params {
+		var s string
+		switch vs, ok := query[qp.Name]; {
+		case ok && len(vs) > 0:
+			s = vs[0]
+		case qp.Default != nil:
+			s = *qp.Default
+		default:
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("query parameter %q is required", qp.Name)}
+		}
+
+		v, err := queryParamValue(qp, s)
+		if err != nil {
+			return nil, &statusError{http.StatusBadRequest, fmt.Errorf("query parameter %q: %v", qp.Name, err)}
+		}
+		params = append(params, bigquery.QueryParameter{Name: qp.Name, Value: v})
+	}
+	return params, nil
+}
+
+// queryParamValue validates s against the declaration of the parameter and returns it as a typed query parameter
+// value.
+func queryParamValue(qp queryParam, s string) (*bigquery.QueryParameterValue, error) {
+	if len(qp.Values) > 0 && !containsString(qp.Values, s) {
+		return nil, fmt.Errorf("%q is not one of %s", s, strings.Join(qp.Values, ", "))
+	}
+	if qp.Pattern != "" {
+		re, err := regexp.Compile("^(?:" + qp.Pattern + ")$")
+		if err != nil {
+			return nil, err
+		}
+		if !re.MatchString(s) {
+			return nil, fmt.Errorf("%q does not match %s", s, qp.Pattern)
+		}
+	}
+
+	typ := strings.ToUpper(qp.Type)
+	if typ == "" {
+		typ = "STRING"
+	}
+
+	// Values are sent in their canonical string form, which BigQuery parses according to the parameter type.
+	var num float64
+	numeric := true
+	switch typ {
+	case "STRING":
+		numeric = false
+
+	case "INT64":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an INT64", s)
+		}
+		s, num = strconv.FormatInt(n, 10), float64(n)
+
+	case "FLOAT64":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a FLOAT64", s)
+		}
+		s, num = strconv.FormatFloat(f, 'g', -1, 64), f
+
+	case "NUMERIC", "BIGNUMERIC":
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a %s", s, typ)
+		}
+		if typ == "NUMERIC" {
+			s = bigquery.NumericString(r)
+		} else {
+			s = bigquery.BigNumericString(r)
+		}
+		num, _ = r.Float64()
+
+	case "BOOL":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a BOOL", s)
+		}
+		s, numeric = strconv.FormatBool(b), false
+
+	case "DATE":
+		d, err := civil.ParseDate(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a DATE such as 2024-01-31", s)
+		}
+		s, numeric = d.String(), false
+
+	case "DATETIME":
+		dt, err := civil.ParseDateTime(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a DATETIME such as 2024-01-31T12:00:00", s)
+		}
+		s, numeric = bigquery.CivilDateTimeString(dt), false
+
+	case "TIMESTAMP":
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a TIMESTAMP such as 2024-01-31T12:00:00Z", s)
+		}
+		s, numeric = t.Format(timestampParamFormat), false
+
+	default:
+		return nil, fmt.Errorf("unsupported type %q", qp.Type)
+	}
+
+	if (qp.Min != nil || qp.Max != nil) && !numeric {
+		return nil, fmt.Errorf("min and max only apply to numeric parameters, not %s", typ)
+	}
+	if qp.Min != nil && num < *qp.Min {
+		return nil, fmt.Errorf("%s is less than %v", s, *qp.Min)
+	}
+	if qp.Max != nil && num > *qp.Max {
+		return nil, fmt.Errorf("%s is greater than %v", s, *qp.Max)
+	}
+
+	return &bigquery.QueryParameterValue{
+		Type:  bigquery.StandardSQLDataType{TypeKind: typ},
+		Value: s,
+	}, nil
+}
+
+// containsString reports whether ss contains s.
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
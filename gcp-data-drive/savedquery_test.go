@@ -0,0 +1,142 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestQueryParamValue(t *testing.T) {
+	zero, ten := 0.0, 10.0
+	var tests = []struct {
+		param queryParam
+		in    string
+		want  string
+		ok    bool
+	}{
+		{queryParam{}, "EU", "EU", true},
+		{queryParam{Type: "int64"}, "007", "7", true},
+		{queryParam{Type: "INT64"}, "7.5", "", false},
+		{queryParam{Type: "INT64", Min: &zero, Max: &ten}, "11", "", false},
+		{queryParam{Type: "FLOAT64", Min: &zero}, "-0.5", "", false},
+		{queryParam{Type: "NUMERIC"}, "1.50", "1.500000000", true},
+		{queryParam{Type: "BOOL"}, "1", "true", true},
+		{queryParam{Type: "DATE"}, "2024-01-31", "2024-01-31", true},
+		{queryParam{Type: "DATE"}, "31/01/2024", "", false},
+		{queryParam{Type: "DATETIME"}, "2024-01-31T12:30:00", "2024-01-31 12:30:00", true},
+		{queryParam{Type: "TIMESTAMP"}, "2024-01-31T12:30:00Z", "2024-01-31 12:30:00+00:00", true},
+		{queryParam{Values: []string{"EU", "US"}}, "ASIA", "", false},
+		{queryParam{Pattern: "[A-Z]{2}"}, "EUR", "", false},
+		{queryParam{Pattern: "[A-Z]{2}"}, "EU", "EU", true},
+		{queryParam{Max: &ten}, "EU", "", false},
+		{queryParam{Type: "GEOGRAPHY"}, "POINT(0 0)", "", false},
+	}
+
+	for _, item := range tests {
+		have, err := queryParamValue(item.param, item.in)
+		if !item.ok {
+			if err == nil {
+				t.Errorf("queryParamValue(%+v, %q): An error was expected but no error was returned", item.param, item.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("queryParamValue(%+v, %q) error: %v", item.param, item.in, err)
+			continue
+		}
+		if have.Value != item.want {
+			t.Errorf("queryParamValue(%+v, %q) = %v Want: %v", item.param, item.in, have.Value, item.want)
+		}
+	}
+}
+
+func TestSavedQueryParams(t *testing.T) {
+	since := "2024-01-01"
+	sq := &savedQuery{Params: []queryParam{
+		{Name: "region"},
+		{Name: "since", Type: "DATE", Default: &since},
+	}}
+
+	have, err := savedQueryParams(sq, url.Values{"region": {"EU"}, "types": {"strict"}})
+	if err != nil {
+		t.Fatalf("savedQueryParams() error: %v", err)
+	}
+	want := []bigquery.QueryParameter{
+		{Name: "region", Value: &bigquery.QueryParameterValue{Type: bigquery.StandardSQLDataType{TypeKind: "STRING"}, Value: "EU"}},
+		{Name: "since", Value: &bigquery.QueryParameterValue{Type: bigquery.StandardSQLDataType{TypeKind: "DATE"}, Value: "2024-01-01"}},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("savedQueryParams() = %+v Want: %+v", have, want)
+	}
+
+	if _, err := savedQueryParams(sq, url.Values{}); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("savedQueryParams(missing region) error = %v Want: 400 Bad Request", err)
+	}
+	if _, err := savedQueryParams(sq, url.Values{"region": {"EU"}, "since": {"yesterday"}}); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("savedQueryParams(since=yesterday) error = %v Want: 400 Bad Request", err)
+	}
+}
+
+func TestNewSavedQueryPlatform(t *testing.T) {
+	setConfig(&config{Queries: []savedQuery{{
+		Name:    "sales_by_region",
+		Project: "p",
+		SQL:     "select * from `p.sales.orders` where region = @region",
+		Params:  []queryParam{{Name: "region"}},
+	}}})
+	defer setConfig(&config{})
+
+	var tests = []struct {
+		in   string
+		code int
+	}{
+		{"https://example.com/q/sales_by_region?region=EU", 0},
+		{"https://example.com/q/sales_by_region", http.StatusBadRequest},
+		{"https://example.com/q/missing", http.StatusNotFound},
+	}
+
+	for _, item := range tests {
+		req, _ := http.NewRequest("GET", item.in, nil)
+		p, err := parseDDURL(req)
+		if err != nil {
+			t.Fatalf("parseDDURL(%q) error: %v", item.in, err)
+		}
+		pd, err := parseDataPlatform(context.Background(), p)
+		if item.code != 0 {
+			if errorStatus(err) != item.code {
+				t.Errorf("parseDataPlatform(%q) error = %v Want: status %d", item.in, err, item.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseDataPlatform(%q) error: %v", item.in, err)
+		}
+		defer pd.close()
+
+		bq, ok := pd.(*bqDataPlatform)
+		if !ok {
+			t.Fatalf("parseDataPlatform(%q) = %T Want: *gcpdatadrive.bqDataPlatform", item.in, pd)
+		}
+		if bq.client.Project() != "p" || len(bq.query.Parameters) != 1 || !bq.query.UseStandardSQL {
+			t.Errorf("parseDataPlatform(%q) = %+v Want: the parameterized query in project p", item.in, bq.query.QueryConfig)
+		}
+	}
+}
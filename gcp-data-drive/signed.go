@@ -0,0 +1,266 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// signedCookie is the cookie carrying a signed URL prefix.
+	signedCookie = "Edge-Cache-Cookie"
+
+	// signedPathToken starts the path component carrying a signed URL prefix.
+	signedPathToken = "/edge-cache-token="
+
+	// signatureParam starts the signature in every format. It is always the last field.
+	signatureParam = "Signature="
+)
+
+// signedQueryParams are the query parameters of signed URLs. They are removed from the request once verified.
+var signedQueryParams = []string{"Expires", "KeyName", "Signature", "URLPrefix"}
+
+// signedToken is the signed part of a request and the fields read from it.
+type signedToken struct {
+	// signed is the exact string the signature was made over.
+	signed    string
+	signature string
+	keyName   string
+	expires   int64
+
+	// prefix is the URL prefix the signature is valid for, or empty when it is only valid for the exact URL.
+	prefix string
+}
+
+// verifySignedRequest checks the Media CDN signature of the request: a signed URL, a signed URL prefix in the query,
+// an Edge-Cache-Cookie cookie or an edge-cache-token path component. Requests with an expired, tampered or unknown
+// signature, and requests without a signature on a route that requires one, are rejected with 403 Forbidden. The
+// returned request has the signature removed from its path and query.
+func verifySignedRequest(r *http.Request, cfg *signedRequestsConfig, now time.Time) (*http.Request, error) {
+	if len(cfg.Keysets) == 0 {
+		return r, nil
+	}
+
+	origin := requestScheme(r) + "://" + r.Host
+	tok, r, err := parseSignedToken(r, origin)
+	if err != nil {
+		return nil, &statusError{http.StatusForbidden, err}
+	}
+	if tok == nil {
+		if signatureRequired(cfg, r.URL.Path) {
+			return nil, &statusError{http.StatusForbidden, fmt.Errorf("%s requires a signed request", r.URL.Path)}
+		}
+		return r, nil
+	}
+
+	if now.Unix() >= tok.expires {
+		return nil, &statusError{http.StatusForbidden, errors.New("the signed request has expired")}
+	}
+	if tok.prefix != "" && !strings.HasPrefix(origin+r.URL.RequestURI(), tok.prefix) {
+		return nil, &statusError{http.StatusForbidden, errors.New("the signed URL prefix does not match the request")}
+	}
+	sig, err := decodeSignedBase64(tok.signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, &statusError{http.StatusForbidden, errors.New("the request signature is malformed")}
+	}
+	keys, ok := cfg.Keysets[tok.keyName]
+	if !ok {
+		return nil, &statusError{http.StatusForbidden, fmt.Errorf("unknown keyset %q", tok.keyName)}
+	}
+	for _, k := range keys {
+		pub, err := decodeSignedBase64(k)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("signedRequests.keysets[%q] has a malformed public key", tok.keyName)
+		}
+		if ed25519.Verify(ed25519.PublicKey(pub), []byte(tok.signed), sig) {
+			return r, nil
+		}
+	}
+	return nil, &statusError{http.StatusForbidden, errors.New("the request signature is not valid")}
+}
+
+// signatureRequired reports whether the path may only be requested with a signature.
+func signatureRequired(cfg *signedRequestsConfig, path string) bool {
+	if len(cfg.Routes) == 0 {
+		return true
+	}
+	for _, route := range cfg.Routes {
+		if routeMatches(route, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestScheme returns the scheme the client used, as reported by the load balancer in front of the service.
+func requestScheme(r *http.Request) string {
+	if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+		return strings.TrimSpace(strings.Split(p, ",")[0])
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// parseSignedToken returns the signed token of the request, or nil when it is not signed, and the request with the
+// token removed so that it is routed and cached as if it were not signed.
+func parseSignedToken(r *http.Request, origin string) (*signedToken, *http.Request, error) {
+	// A path component: {prefix}/edge-cache-token=Expires=...&KeyName=...&Signature=.../{rest}
+	if p := r.URL.EscapedPath(); strings.Contains(p, signedPathToken) {
+		i := strings.Index(p, signedPathToken)
+		component := p[i+len(signedPathToken):]
+		rest := ""
+		if j := strings.Index(component, "/"); j >= 0 {
+			component, rest = component[:j], component[j:]
+		}
+		j := strings.LastIndex(component, "&"+signatureParam)
+		if j < 0 {
+			return nil, nil, errors.New("the edge-cache-token path component has no signature")
+		}
+		tok, err := newSignedToken(origin+p[:i]+signedPathToken+component[:j], "&", component[j+1+len(signatureParam):])
+		if err != nil {
+			return nil, nil, err
+		}
+		tok.prefix = origin + p[:i]
+
+		u := *r.URL
+		if err := setEscapedPath(&u, p[:i]+rest); err != nil {
+			return nil, nil, err
+		}
+		r = r.Clone(r.Context())
+		r.URL = &u
+		return tok, r, nil
+	}
+
+	// Query parameters: a signed URL ending in Expires, KeyName and Signature, or a signed prefix starting at
+	// URLPrefix.
+	if q := r.URL.RawQuery; strings.Contains(q, signatureParam) {
+		j := strings.LastIndex(q, "&"+signatureParam)
+		if j < 0 {
+			return nil, nil, errors.New("the signature must be the last query parameter")
+		}
+		sig := q[j+1+len(signatureParam):]
+
+		var tok *signedToken
+		var err error
+		if i := strings.Index(q, "URLPrefix="); i == 0 || i > 0 && q[i-1] == '&' {
+			tok, err = newSignedToken(q[i:j], "&", sig)
+		} else {
+			// The signature covers the whole URL up to the Signature parameter.
+			tok, err = newSignedToken(origin+r.URL.EscapedPath()+"?"+q[:j], "&", sig)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		u := *r.URL
+		values := u.Query()
+		for _, name := range signedQueryParams {
+			values.Del(name)
+		}
+		u.RawQuery = values.Encode()
+		r = r.Clone(r.Context())
+		r.URL = &u
+		return tok, r, nil
+	}
+
+	// A cookie: URLPrefix=...:Expires=...:KeyName=...:Signature=...
+	if c, err := r.Cookie(signedCookie); err == nil {
+		j := strings.LastIndex(c.Value, ":"+signatureParam)
+		if j < 0 {
+			return nil, nil, fmt.Errorf("the %s cookie has no signature", signedCookie)
+		}
+		tok, err := newSignedToken(c.Value[:j], ":", c.Value[j+1+len(signatureParam):])
+		if err != nil {
+			return nil, nil, err
+		}
+		if tok.prefix == "" {
+			return nil, nil, fmt.Errorf("the %s cookie has no URLPrefix", signedCookie)
+		}
+		return tok, r, nil
+	}
+	return nil, r, nil
+}
+
+// newSignedToken reads the Expires, KeyName and URLPrefix fields of the signed string, whose fields are separated by
+// sep.
+func newSignedToken(signed, sep, signature string) (*signedToken, error) {
+	tok := &signedToken{signed: signed, signature: signature}
+
+	// Only the fields after the URL and its own query parameters are read.
+	fields := signed
+	if i := strings.LastIndex(fields, "?"); i >= 0 {
+		fields = fields[i+1:]
+	}
+	if i := strings.LastIndex(fields, signedPathToken); i >= 0 {
+		fields = fields[i+len(signedPathToken):]
+	}
+	for _, f := range strings.Split(fields, sep) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Expires":
+			n, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed Expires %q", kv[1])
+			}
+			tok.expires = n
+		case "KeyName":
+			tok.keyName = kv[1]
+		case "URLPrefix":
+			prefix, err := decodeSignedBase64(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("malformed URLPrefix %q", kv[1])
+			}
+			tok.prefix = string(prefix)
+		}
+	}
+	if tok.expires == 0 || tok.keyName == "" {
+		return nil, errors.New("the signed request must have Expires and KeyName")
+	}
+	return tok, nil
+}
+
+// decodeSignedBase64 decodes the base64url values of signed requests, with or without padding.
+func decodeSignedBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// setEscapedPath replaces the path of the URL with the escaped path.
+func setEscapedPath(u *url.URL, escaped string) error {
+	if escaped == "" {
+		escaped = "/"
+	}
+	p, err := url.PathUnescape(escaped)
+	if err != nil {
+		return err
+	}
+	u.Path, u.RawPath = p, ""
+	if p != escaped {
+		u.RawPath = escaped
+	}
+	return nil
+}
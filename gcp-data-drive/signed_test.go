@@ -0,0 +1,85 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signWith returns the base64url signature of the string, as the signed-requests tool writes it.
+func signWith(key ed25519.PrivateKey, s string) string {
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(s)))
+}
+
+func TestVerifySignedRequest(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error: %v", err)
+	}
+	cfg := &signedRequestsConfig{
+		Keysets: map[string][]string{"links": {base64.RawURLEncoding.EncodeToString(pub)}},
+		Routes:  []string{"bq/p/shared/*"},
+	}
+	now := time.Unix(1600000000, 0)
+	exp := now.Add(time.Hour).Unix()
+	b64 := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	signedURL := fmt.Sprintf("http://example.com/bq/p/shared/v?types=strict&Expires=%d&KeyName=links", exp)
+	expiredURL := fmt.Sprintf("http://example.com/bq/p/shared/v?Expires=%d&KeyName=links", now.Unix()-1)
+	prefix := fmt.Sprintf("URLPrefix=%s&Expires=%d&KeyName=links", b64("http://example.com/bq/p/shared/"), exp)
+	cookie := fmt.Sprintf("URLPrefix=%s:Expires=%d:KeyName=links", b64("http://example.com/bq/p/shared/"), exp)
+	component := fmt.Sprintf("http://example.com/bq/p/shared/edge-cache-token=Expires=%d&KeyName=links", exp)
+
+	var tests = []struct {
+		name   string
+		url    string
+		cookie string
+		want   string
+		code   int
+	}{
+		{"signed URL", signedURL + "&Signature=" + signWith(key, signedURL), "", "/bq/p/shared/v?types=strict", 0},
+		{"tampered URL", signedURL + "&Signature=" + signWith(key, signedURL+"x"), "", "", http.StatusForbidden},
+		{"expired URL", expiredURL + "&Signature=" + signWith(key, expiredURL), "", "", http.StatusForbidden},
+		{"prefix", "http://example.com/bq/p/shared/v?" + prefix + "&Signature=" + signWith(key, prefix), "", "/bq/p/shared/v", 0},
+		{"prefix elsewhere", "http://example.com/bq/p/private/v?" + prefix + "&Signature=" + signWith(key, prefix), "", "", http.StatusForbidden},
+		{"cookie", "http://example.com/bq/p/shared/v", cookie + ":Signature=" + signWith(key, cookie), "/bq/p/shared/v", 0},
+		{"path component", component + "&Signature=" + signWith(key, component) + "/v", "", "/bq/p/shared/v", 0},
+		{"unsigned", "http://example.com/bq/p/shared/v", "", "", http.StatusForbidden},
+		{"unsigned public route", "http://example.com/bq/p/public/v", "", "/bq/p/public/v", 0},
+	}
+
+	for _, item := range tests {
+		req := httptest.NewRequest("GET", item.url, nil)
+		if item.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: signedCookie, Value: item.cookie})
+		}
+		req, err := verifySignedRequest(req, cfg, now)
+		if item.code != 0 {
+			if errorStatus(err) != item.code {
+				t.Errorf("verifySignedRequest(%s) error = %v Want: status %d", item.name, err, item.code)
+			}
+			continue
+		}
+		if err != nil || req.URL.RequestURI() != item.want {
+			t.Errorf("verifySignedRequest(%s) = %v Want: %q", item.name, err, item.want)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tracerName is the instrumentation scope of the spans.
+	tracerName = "github.com/GoogleCloudPlatform/DIY-Tools/gcp-data-drive"
+
+	// defaultServiceName names the service in the traces when tracing.serviceName is not configured.
+	defaultServiceName = "gcp-data-drive"
+
+	// routeAttribute is the span attribute holding the metric route of the request.
+	routeAttribute = attribute.Key("datadrive.route")
+)
+
+var (
+	// tracingOnce guards the installation of the process wide tracer provider.
+	tracingOnce sync.Once
+
+	// tracerProvider is the installed provider that batches the spans to the exporter, or nil.
+	tracerProvider *sdktrace.TracerProvider
+
+	// traceContext propagates the W3C traceparent and tracestate headers.
+	traceContext = propagation.TraceContext{}
+)
+
+// initTracing installs the tracer provider that exports the spans with OTLP/HTTP when tracing is enabled. Without
+// it the global provider records nothing.
+func initTracing(cfg *tracingConfig) {
+	tracingOnce.Do(func() {
+		otel.SetTextMapPropagator(traceContext)
+		if !cfg.Enabled {
+			return
+		}
+
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		exp, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			log.Printf("tracing: creating the OTLP exporter: %v", err)
+			return
+		}
+
+		name := cfg.ServiceName
+		if name == "" {
+			name = defaultServiceName
+		}
+		ratio := 1.0
+		if cfg.SampleRatio != nil {
+			ratio = *cfg.SampleRatio
+		}
+		tracerProvider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exp),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+			sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(name))),
+		)
+		otel.SetTracerProvider(tracerProvider)
+	})
+}
+
+// Shutdown exports the spans still batched and stops the tracer provider. Servers call it once they have stopped
+// serving requests, before the process exits.
+func Shutdown(ctx context.Context) error {
+	// Waiting on tracingOnce orders the read after any installation and keeps a later request from installing a
+	// provider.
+	tracingOnce.Do(func() {})
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+// startRequestSpan starts the server span of a request as a child of the span named by its traceparent header.
+func startRequestSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return otel.Tracer(tracerName).Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+		))
+}
+
+// endRequestSpan names the span after the route of the request, records the response status and ends the span.
+func endRequestSpan(span trace.Span, r *http.Request, l *requestLabels, code int) {
+	_, route := l.get()
+	if route != noLabel {
+		span.SetName(r.Method + " " + route)
+		span.SetAttributes(routeAttribute.String(route))
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(code))
+	if code >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(code))
+	}
+	span.End()
+}
+
+// startSpan starts an internal span below the span of ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+func TestRequestSpans(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+
+	// The row filter rejects the anonymous caller once the path has been parsed.
+	setConfig(&config{
+		RowFilters: []rowFilter{{Route: "/bq/p/d/*", Field: "region", Claim: "region"}},
+		Metrics:    metricsConfig{Routes: []metricsRoute{{Route: "/bq/p/d", Name: "sales"}}},
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var tests = []struct {
+		path      string
+		name      string
+		code      int64
+		parseFail bool
+	}{
+		{"/bq/p/d/v", "GET sales", 403, false},
+		{"/xx/p/d/v", "GET", 500, true},
+	}
+
+	for _, item := range tests {
+		rec := tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+		r := httptest.NewRequest("GET", item.path, nil)
+		r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		GetJSONData(httptest.NewRecorder(), r)
+
+		spans := rec.Ended()
+		if len(spans) != 2 {
+			t.Fatalf("GetJSONData(%s) ended %d spans Want: 2", item.path, len(spans))
+		}
+		parse, server := spans[0], spans[1]
+
+		if parse.Name() != "parse request" || parse.Parent().SpanID() != server.SpanContext().SpanID() {
+			t.Errorf("GetJSONData(%s) first span = %s Want: parse request below the server span", item.path, parse.Name())
+		}
+		if have := parse.Status().Code == codes.Error; have != item.parseFail {
+			t.Errorf("GetJSONData(%s) parse span error = %v Want: %v", item.path, have, item.parseFail)
+		}
+		if server.Name() != item.name {
+			t.Errorf("GetJSONData(%s) server span name = %q Want: %q", item.path, server.Name(), item.name)
+		}
+		if have := server.SpanContext().TraceID().String(); have != traceID {
+			t.Errorf("GetJSONData(%s) trace id = %s Want: %s", item.path, have, traceID)
+		}
+		if have := server.Parent().SpanID().String(); have != "00f067aa0ba902b7" {
+			t.Errorf("GetJSONData(%s) parent span = %s Want: 00f067aa0ba902b7", item.path, have)
+		}
+		var code int64
+		for _, a := range server.Attributes() {
+			if a.Key == semconv.HTTPResponseStatusCodeKey {
+				code = a.Value.AsInt64()
+			}
+		}
+		if code != item.code {
+			t.Errorf("GetJSONData(%s) status attribute = %d Want: %d", item.path, code, item.code)
+		}
+		if have, want := server.Status().Code == codes.Error, item.code >= 500; have != want {
+			t.Errorf("GetJSONData(%s) server span error = %v Want: %v", item.path, have, want)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(prev)
+	defer func() { tracingOnce, tracerProvider = sync.Once{}, nil }()
+
+	var exports int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			atomic.AddInt32(&exports, 1)
+		}
+	}))
+	defer collector.Close()
+
+	tracingOnce = sync.Once{}
+	initTracing(&tracingConfig{Enabled: true, Endpoint: strings.TrimPrefix(collector.URL, "http://"), Insecure: true})
+	_, span := startSpan(context.Background(), "batched")
+	span.End()
+
+	// The batched span is only exported when the provider shuts down.
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error: %v", err)
+	}
+	if n := atomic.LoadInt32(&exports); n != 1 {
+		t.Errorf("Shutdown() exported %d batches Want: 1", n)
+	}
+}
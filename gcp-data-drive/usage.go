@@ -0,0 +1,217 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// usageDayFormat is the layout of the UTC day that daily usage is counted for.
+const usageDayFormat = "2006-01-02"
+
+// keyUsage is the consumption of an API key on a UTC day.
+type keyUsage struct {
+	Key string `json:"key"`
+	Day string `json:"day"`
+
+	// RequestsThisMinute counts the requests of the current minute.
+	RequestsThisMinute int64 `json:"requestsThisMinute"`
+
+	// Requests, Rows and Bytes count the requests made and the rows and bytes returned during the day.
+	Requests int64 `json:"requests"`
+	Rows     int64 `json:"rows"`
+	Bytes    int64 `json:"bytes"`
+
+	// The quotas of the key. Zero means no limit.
+	RequestsPerMinute int64 `json:"requestsPerMinute,omitempty"`
+	DailyRows         int64 `json:"dailyRows,omitempty"`
+	DailyBytes        int64 `json:"dailyBytes,omitempty"`
+}
+
+// usageStore counts the usage of API keys.
+type usageStore interface {
+	// hit counts a request made with the key and returns the number of requests made in the minute of now.
+	hit(ctx context.Context, key string, now time.Time) (int64, error)
+
+	// record adds the rows and bytes of a response to the usage of the key on the day of now.
+	record(ctx context.Context, key string, rows, bytes int64, now time.Time) error
+
+	// usage returns the usage of the key on the day of now.
+	usage(ctx context.Context, key string, now time.Time) (keyUsage, error)
+}
+
+// memoryUsage counts the usage of the keys in process.
+type memoryUsage struct {
+	mu   sync.Mutex
+	keys map[string]*memoryKeyUsage
+}
+
+// memoryKeyUsage is the usage of a key counted by memoryUsage.
+type memoryKeyUsage struct {
+	minute             int64
+	requestsThisMinute int64
+	day                string
+	requests           int64
+	rows               int64
+	bytes              int64
+}
+
+// newMemoryUsage returns an empty in-process usage store.
+func newMemoryUsage() *memoryUsage {
+	return &memoryUsage{keys: map[string]*memoryKeyUsage{}}
+}
+
+// current returns the usage of the key, starting new counts when the minute or the day has changed. The caller
+// holds m.mu.
+func (m *memoryUsage) current(key string, now time.Time) *memoryKeyUsage {
+	u, ok := m.keys[key]
+	if !ok {
+		u = &memoryKeyUsage{}
+		m.keys[key] = u
+	}
+	if minute := now.Unix() / 60; u.minute != minute {
+		u.minute, u.requestsThisMinute = minute, 0
+	}
+	if day := now.UTC().Format(usageDayFormat); u.day != day {
+		*u = memoryKeyUsage{minute: u.minute, requestsThisMinute: u.requestsThisMinute, day: day}
+	}
+	return u
+}
+
+func (m *memoryUsage) hit(ctx context.Context, key string, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.current(key, now)
+	u.requestsThisMinute++
+	u.requests++
+	return u.requestsThisMinute, nil
+}
+
+func (m *memoryUsage) record(ctx context.Context, key string, rows, bytes int64, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.current(key, now)
+	u.rows += rows
+	u.bytes += bytes
+	return nil
+}
+
+func (m *memoryUsage) usage(ctx context.Context, key string, now time.Time) (keyUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.current(key, now)
+	return keyUsage{
+		Key:                key,
+		Day:                u.day,
+		RequestsThisMinute: u.requestsThisMinute,
+		Requests:           u.requests,
+		Rows:               u.rows,
+		Bytes:              u.bytes,
+	}, nil
+}
+
+// redisUsage counts the usage of the keys in Redis so that every instance shares the counts. The minute counters
+// and the daily hashes expire on their own.
+type redisUsage struct {
+	client    redis.UniversalClient
+	keyPrefix string
+}
+
+// newRedisUsage returns the Redis usage store described by the configuration.
+func newRedisUsage(cfg *redisConfig) *redisUsage {
+	prefix := cfg.KeyPrefix
+	if prefix == "" {
+		prefix = defaultRedisKeyPrefix
+	}
+	return &redisUsage{
+		client: redis.NewClient(&redis.Options{
+			Addr:     cfg.Addr,
+			Password: cfg.Password,
+			DB:       cfg.DB,
+		}),
+		keyPrefix: prefix + "usage:",
+	}
+}
+
+// minuteKey and dayKey name the counters of the key for the minute and the day of now.
+func (s *redisUsage) minuteKey(key string, now time.Time) string {
+	return s.keyPrefix + key + ":minute:" + strconv.FormatInt(now.Unix()/60, 10)
+}
+
+func (s *redisUsage) dayKey(key string, now time.Time) string {
+	return s.keyPrefix + key + ":day:" + now.UTC().Format(usageDayFormat)
+}
+
+func (s *redisUsage) hit(ctx context.Context, key string, now time.Time) (int64, error) {
+	pipe := s.client.TxPipeline()
+	n := pipe.Incr(ctx, s.minuteKey(key, now))
+	pipe.Expire(ctx, s.minuteKey(key, now), 2*time.Minute)
+	pipe.HIncrBy(ctx, s.dayKey(key, now), "requests", 1)
+	pipe.Expire(ctx, s.dayKey(key, now), 48*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return n.Val(), nil
+}
+
+func (s *redisUsage) record(ctx context.Context, key string, rows, bytes int64, now time.Time) error {
+	pipe := s.client.TxPipeline()
+	pipe.HIncrBy(ctx, s.dayKey(key, now), "rows", rows)
+	pipe.HIncrBy(ctx, s.dayKey(key, now), "bytes", bytes)
+	pipe.Expire(ctx, s.dayKey(key, now), 48*time.Hour)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisUsage) usage(ctx context.Context, key string, now time.Time) (keyUsage, error) {
+	u := keyUsage{Key: key, Day: now.UTC().Format(usageDayFormat)}
+
+	pipe := s.client.Pipeline()
+	minute := pipe.Get(ctx, s.minuteKey(key, now))
+	day := pipe.HGetAll(ctx, s.dayKey(key, now))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return u, err
+	}
+
+	u.RequestsThisMinute, _ = minute.Int64()
+	u.Requests, _ = strconv.ParseInt(day.Val()["requests"], 10, 64)
+	u.Rows, _ = strconv.ParseInt(day.Val()["rows"], 10, 64)
+	u.Bytes, _ = strconv.ParseInt(day.Val()["bytes"], 10, 64)
+	return u, nil
+}
+
+var (
+	// usageOnce guards the creation of the process wide usage store.
+	usageOnce sync.Once
+	keyUsages usageStore
+)
+
+// getUsageStore returns the process wide usage store: the shared Redis store when apiKeys.redis is configured and
+// the in-process store otherwise.
+func getUsageStore(cfg *apiKeysConfig) usageStore {
+	usageOnce.Do(func() {
+		if cfg.Redis != nil {
+			keyUsages = newRedisUsage(cfg.Redis)
+			return
+		}
+		keyUsages = newMemoryUsage()
+	})
+	return keyUsages
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestUsageStores(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rs := newRedisUsage(&redisConfig{Addr: mr.Addr()})
+	t.Cleanup(func() { rs.client.Close() })
+
+	stores := map[string]usageStore{"memory": newMemoryUsage(), "redis": rs}
+	ctx := context.Background()
+	now := time.Date(2020, 6, 1, 23, 59, 30, 0, time.UTC)
+
+	for name, s := range stores {
+		for i := 0; i < 3; i++ {
+			if _, err := s.hit(ctx, "k", now); err != nil {
+				t.Fatalf("%s: hit() error: %v", name, err)
+			}
+		}
+		if err := s.record(ctx, "k", 5, 100, now); err != nil {
+			t.Fatalf("%s: record() error: %v", name, err)
+		}
+		want := keyUsage{Key: "k", Day: "2020-06-01", RequestsThisMinute: 3, Requests: 3, Rows: 5, Bytes: 100}
+		if have, err := s.usage(ctx, "k", now); err != nil || have != want {
+			t.Errorf("%s: usage(%v) = %+v, %v Want: %+v", name, now, have, err, want)
+		}
+
+		// The next minute is also the next day, so every count starts over.
+		next := now.Add(time.Minute)
+		if n, err := s.hit(ctx, "k", next); err != nil || n != 1 {
+			t.Errorf("%s: hit(next minute) = %d, %v Want: 1", name, n, err)
+		}
+		want = keyUsage{Key: "k", Day: "2020-06-02", RequestsThisMinute: 1, Requests: 1}
+		if have, err := s.usage(ctx, "k", next); err != nil || have != want {
+			t.Errorf("%s: usage(%v) = %+v, %v Want: %+v", name, next, have, err, want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// wktParser converts the well-known text that BigQuery returns for GEOGRAPHY values into GeoJSON geometries.
+type wktParser struct {
+	// s is the well-known text being parsed.
+	s string
+
+	// pos is the offset of the next unread byte in s.
+	pos int
+}
+
+// wktToGeoJSON parses a well-known text geometry and returns the equivalent GeoJSON geometry object.
+func wktToGeoJSON(s string) (map[string]interface{}, error) {
+	p := &wktParser{s: s}
+	g, err := p.geometry()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos != len(p.s) {
+		return nil, fmt.Errorf("wkt: unexpected text %q after geometry", p.s[p.pos:])
+	}
+	return g, nil
+}
+
+// geometry parses a single tagged geometry such as POINT(1 2).
+func (p *wktParser) geometry() (map[string]interface{}, error) {
+	tag := strings.ToUpper(p.word())
+
+	if tag == "GEOMETRYCOLLECTION" {
+		geoms := []interface{}{}
+		if !p.empty() {
+			if err := p.expect('('); err != nil {
+				return nil, err
+			}
+			for {
+				g, err := p.geometry()
+				if err != nil {
+					return nil, err
+				}
+				geoms = append(geoms, g)
+				if !p.consume(',') {
+					break
+				}
+			}
+			if err := p.expect(')'); err != nil {
+				return nil, err
+			}
+		}
+		return map[string]interface{}{"type": "GeometryCollection", "geometries": geoms}, nil
+	}
+
+	var typ string
+	var coords interface{}
+	var err error
+	switch tag {
+	case "POINT":
+		typ = "Point"
+		if p.empty() {
+			coords = []float64{}
+			break
+		}
+		coords, err = p.pointText()
+
+	case "LINESTRING":
+		typ = "LineString"
+		coords, err = p.coordList()
+
+	case "POLYGON":
+		typ = "Polygon"
+		coords, err = p.ringList()
+
+	case "MULTIPOINT":
+		typ = "MultiPoint"
+		coords, err = p.coordList()
+
+	case "MULTILINESTRING":
+		typ = "MultiLineString"
+		coords, err = p.ringList()
+
+	case "MULTIPOLYGON":
+		typ = "MultiPolygon"
+		coords, err = p.polygonList()
+
+	default:
+		return nil, fmt.Errorf("wkt: unsupported geometry type %q", tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"type": typ, "coordinates": coords}, nil
+}
+
+// pointText parses a parenthesized coordinate such as (1 2).
+func (p *wktParser) pointText() ([]float64, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	c, err := p.coord()
+	if err != nil {
+		return nil, err
+	}
+	return c, p.expect(')')
+}
+
+// coordList parses a parenthesized list of coordinates. Multipoint members may optionally be parenthesized.
+func (p *wktParser) coordList() ([][]float64, error) {
+	res := [][]float64{}
+	if p.empty() {
+		return res, nil
+	}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	for {
+		var c []float64
+		var err error
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == '(' {
+			c, err = p.pointText()
+		} else {
+			c, err = p.coord()
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+		if !p.consume(',') {
+			break
+		}
+	}
+	return res, p.expect(')')
+}
+
+// ringList parses a parenthesized list of coordinate lists, as used by polygons and multilinestrings.
+func (p *wktParser) ringList() ([][][]float64, error) {
+	res := [][][]float64{}
+	if p.empty() {
+		return res, nil
+	}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	for {
+		r, err := p.coordList()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+		if !p.consume(',') {
+			break
+		}
+	}
+	return res, p.expect(')')
+}
+
+// polygonList parses a parenthesized list of polygons.
+func (p *wktParser) polygonList() ([][][][]float64, error) {
+	res := [][][][]float64{}
+	if p.empty() {
+		return res, nil
+	}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	for {
+		r, err := p.ringList()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+		if !p.consume(',') {
+			break
+		}
+	}
+	return res, p.expect(')')
+}
+
+// coord parses the space separated ordinates of a single position.
+func (p *wktParser) coord() ([]float64, error) {
+	var c []float64
+	for {
+		p.skipSpace()
+		start := p.pos
+		for p.pos < len(p.s) && strings.IndexByte("0123456789+-.eE", p.s[p.pos]) >= 0 {
+			p.pos++
+		}
+		if start == p.pos {
+			break
+		}
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("wkt: invalid ordinate %q", p.s[start:p.pos])
+		}
+		c = append(c, f)
+	}
+	if len(c) < 2 {
+		return nil, fmt.Errorf("wkt: expected a coordinate at offset %d", p.pos)
+	}
+	return c, nil
+}
+
+// word reads the next run of letters.
+func (p *wktParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && (p.s[p.pos] >= 'A' && p.s[p.pos] <= 'Z' || p.s[p.pos] >= 'a' && p.s[p.pos] <= 'z') {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// empty consumes the EMPTY keyword if it is next and reports whether it was found.
+func (p *wktParser) empty() bool {
+	start := p.pos
+	if strings.ToUpper(p.word()) == "EMPTY" {
+		return true
+	}
+	p.pos = start
+	return false
+}
+
+// consume skips the byte b if it is next and reports whether it was found.
+func (p *wktParser) consume(b byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == b {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expect consumes the byte b or returns an error if it is not next.
+func (p *wktParser) expect(b byte) error {
+	if !p.consume(b) {
+		return fmt.Errorf("wkt: expected %q at offset %d", b, p.pos)
+	}
+	return nil
+}
+
+// skipSpace advances past any whitespace.
+func (p *wktParser) skipSpace() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// 	https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcpdatadrive
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestWKTToGeoJSON(t *testing.T) {
+	var tests = []struct {
+		in    string
+		out   string
+		isErr bool
+	}{
+		{"POINT(1 2)", `{"coordinates":[1,2],"type":"Point"}`, false},
+		{"point ( -1.5 2e1 )", `{"coordinates":[-1.5,20],"type":"Point"}`, false},
+		{"POINT EMPTY", `{"coordinates":[],"type":"Point"}`, false},
+		{"LINESTRING(1 2, 3 4)", `{"coordinates":[[1,2],[3,4]],"type":"LineString"}`, false},
+		{"POLYGON((0 0, 1 0, 1 1, 0 0))", `{"coordinates":[[[0,0],[1,0],[1,1],[0,0]]],"type":"Polygon"}`, false},
+		{"MULTIPOINT(1 2, (3 4))", `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`, false},
+		{"MULTILINESTRING((1 2, 3 4), (5 6, 7 8))", `{"coordinates":[[[1,2],[3,4]],[[5,6],[7,8]]],"type":"MultiLineString"}`, false},
+		{"MULTIPOLYGON(((0 0, 1 0, 1 1, 0 0)))", `{"coordinates":[[[[0,0],[1,0],[1,1],[0,0]]]],"type":"MultiPolygon"}`, false},
+		{"GEOMETRYCOLLECTION(POINT(1 2), LINESTRING(1 2, 3 4))",
+			`{"geometries":[{"coordinates":[1,2],"type":"Point"},{"coordinates":[[1,2],[3,4]],"type":"LineString"}],"type":"GeometryCollection"}`,
+			false,
+		},
+		{"GEOMETRYCOLLECTION EMPTY", `{"geometries":[],"type":"GeometryCollection"}`, false},
+		{"CIRCLE(1 2)", "", true},
+		{"POINT(1)", "", true},
+		{"POINT(1 2", "", true},
+		{"POINT(1 2) extra", "", true},
+	}
+
+	for _, item := range tests {
+		g, err := wktToGeoJSON(item.in)
+		if item.isErr {
+			if err == nil {
+				t.Errorf("wktToGeoJSON(%q): An error was expected but no error was returned", item.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("wktToGeoJSON(%q): unexpected error %v", item.in, err)
+			continue
+		}
+
+		have, _ := json.Marshal(g)
+		if string(have) != item.out {
+			t.Errorf("wktToGeoJSON(%q) = %s Want: %s", item.in, have, item.out)
+		}
+	}
+}